@@ -0,0 +1,504 @@
+package switchboard
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultCacheMaxEntries   = 1024
+	DefaultCacheMaxSize      = 64 * 1024 * 1024
+	DefaultCacheMaxEntrySize = 1024 * 1024
+)
+
+var (
+	// cacheableStatuses may be stored, other responses always run the
+	// pipeline
+	cacheableStatuses = map[int]bool{
+		http.StatusOK:                   true,
+		http.StatusNonAuthoritativeInfo: true,
+		http.StatusNoContent:            true,
+		http.StatusMultipleChoices:      true,
+		http.StatusMovedPermanently:     true,
+		http.StatusPermanentRedirect:    true,
+		http.StatusNotFound:             true,
+		http.StatusGone:                 true,
+	}
+)
+
+type CacheConfig struct {
+	MaxEntries   int
+	MaxSize      int64
+	MaxEntrySize int64
+	Dir          string
+}
+
+// CacheRules enable caching for a route. The cache key is made from the
+// host, path, the listed query parameters and the listed request headers.
+type CacheRules struct {
+	TTL     time.Duration
+	Query   []string
+	Headers []string
+}
+
+// Cache stores responses to GET and HEAD requests so later requests skip
+// the route's command and after commands. Stages that run before the
+// route's command, such as auth and before commands, run for every request,
+// see CacheRecorder.Lookup. Entries are evicted when they expire, and least recently
+// used entries are evicted when the cache exceeds its limits. Bodies are
+// kept in memory unless a directory is configured.
+//
+// Commands control caching with tags:
+//
+//   CACHE_TTL
+//   Caches the response for a duration such as 30s, or disables caching
+//   with 0. Overrides the route's ttl.
+//
+//   CACHE_KEY
+//   Sets the key used to purge the response, defaults to the request path
+//
+//   CACHE_BYPASS
+//   Does not cache the response when true
+//
+//   CACHE_PURGE
+//   Removes responses with the key, or with keys starting with the prefix
+//   when the value ends in "*". Works for any method.
+//
+// Responses that set cookies, or that have a private or no-store
+// Cache-Control header, are never cached. Requests with a no-cache
+// Cache-Control header skip cached responses.
+type Cache struct {
+	config  CacheConfig
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	size    int64
+}
+
+type CacheEntry struct {
+	Key      string
+	PurgeKey string
+	Status   int
+	Header   http.Header
+	Body     []byte
+	Size     int64
+	Stored   time.Time
+	Expires  time.Time
+	path     string
+}
+
+func NewCache(config CacheConfig) (*Cache, error) {
+	if config.MaxEntries == 0 {
+		config.MaxEntries = DefaultCacheMaxEntries
+	}
+	if config.MaxSize == 0 {
+		config.MaxSize = DefaultCacheMaxSize
+	}
+	if config.MaxEntrySize == 0 {
+		config.MaxEntrySize = DefaultCacheMaxEntrySize
+	}
+
+	if config.Dir != "" {
+		err := os.MkdirAll(config.Dir, 0700)
+		if err != nil {
+			return nil, fmt.Errorf("error creating cache directory: %s", err)
+		}
+	}
+
+	return &Cache{
+		config:  config,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}, nil
+}
+
+func (cache *Cache) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), cacheKey, cache)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Get returns the entry for key, or nil if there is no fresh entry
+func (cache *Cache) Get(key string) *CacheEntry {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	element, ok := cache.entries[key]
+	if !ok {
+		return nil
+	}
+
+	entry := element.Value.(*CacheEntry)
+	if time.Now().After(entry.Expires) {
+		cache.remove(element)
+		return nil
+	}
+
+	if entry.path != "" {
+		body, err := ioutil.ReadFile(entry.path)
+		if err != nil {
+			log.Printf("error reading cached response: %s", err)
+			cache.remove(element)
+			return nil
+		}
+		e := *entry
+		e.Body = body
+		entry = &e
+	}
+
+	cache.lru.MoveToFront(element)
+	return entry
+}
+
+func (cache *Cache) Set(entry *CacheEntry) {
+	entry.Size = int64(len(entry.Body))
+	if entry.Size > cache.config.MaxEntrySize {
+		return
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	// The old entry is removed first as it is stored in the same file
+	if element, ok := cache.entries[entry.Key]; ok {
+		cache.remove(element)
+	}
+
+	if cache.config.Dir != "" {
+		sum := sha256.Sum256([]byte(entry.Key))
+		entry.path = filepath.Join(cache.config.Dir, hex.EncodeToString(sum[:]))
+		err := ioutil.WriteFile(entry.path, entry.Body, 0600)
+		if err != nil {
+			log.Printf("error writing cached response: %s", err)
+			return
+		}
+		entry.Body = nil
+	}
+
+	cache.entries[entry.Key] = cache.lru.PushFront(entry)
+	cache.size += entry.Size
+
+	for cache.lru.Len() > cache.config.MaxEntries || cache.size > cache.config.MaxSize {
+		cache.remove(cache.lru.Back())
+	}
+}
+
+// Purge removes entries with the purge key, or with purge keys starting
+// with the prefix when pattern ends in "*"
+func (cache *Cache) Purge(pattern string) int {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	prefix := strings.HasSuffix(pattern, "*")
+	pattern = strings.TrimSuffix(pattern, "*")
+
+	purged := 0
+	for _, element := range cache.entries {
+		entry := element.Value.(*CacheEntry)
+		if entry.PurgeKey == pattern || (prefix && strings.HasPrefix(entry.PurgeKey, pattern)) {
+			cache.remove(element)
+			purged++
+		}
+	}
+	return purged
+}
+
+func (cache *Cache) remove(element *list.Element) {
+	entry := element.Value.(*CacheEntry)
+	if entry.path != "" {
+		os.Remove(entry.path)
+	}
+	cache.lru.Remove(element)
+	delete(cache.entries, entry.Key)
+	cache.size -= entry.Size
+}
+
+// Write responds with the cached response, answering conditional requests
+// from its ETag and Last-Modified headers
+func (entry *CacheEntry) Write(w http.ResponseWriter, r *http.Request) {
+	for key, values := range entry.Header {
+		w.Header()[key] = values
+	}
+	age := time.Since(entry.Stored) / time.Second
+	w.Header().Set("Age", strconv.Itoa(int(age)))
+	w.Header().Set("X-Cache", "HIT")
+
+	if entry.Status >= 200 && entry.Status < 300 {
+		lastModified, _ := http.ParseTime(entry.Header.Get("Last-Modified"))
+		if precondition := CheckPreconditions(r, entry.Header.Get("ETag"), lastModified); precondition != 0 {
+			w.WriteHeader(precondition)
+			return
+		}
+	}
+
+	w.WriteHeader(entry.Status)
+	w.Write(entry.Body)
+}
+
+// CacheKey builds the key for the request. Without rules every query
+// parameter is included.
+func CacheKey(r *http.Request, rules *CacheRules) string {
+	query := r.URL.Query()
+	if rules != nil {
+		selected := make(url.Values)
+		for _, name := range rules.Query {
+			if values, ok := query[name]; ok {
+				selected[name] = values
+			}
+		}
+		query = selected
+	}
+
+	key := fmt.Sprintf("%s%s?%s", r.Host, r.URL.Path, query.Encode())
+	if rules != nil {
+		headers := append([]string{}, rules.Headers...)
+		sort.Strings(headers)
+		for _, name := range headers {
+			key += fmt.Sprintf("\n%s: %s", HeaderName(name), strings.Join(r.Header.Values(name), ", "))
+		}
+	}
+	return key
+}
+
+// CacheRules returns the cache rules of the innermost route in the pipeline
+func (pipeline Pipeline) CacheRules() *CacheRules {
+	for i := len(pipeline) - 1; i >= 0; i-- {
+		switch r := pipeline[i].(type) {
+		case *BasicRoute:
+			if r.Cache != nil {
+				return r.Cache
+			}
+		case *ResourceRoute:
+			if r.Cache != nil {
+				return r.Cache
+			}
+		}
+	}
+	return nil
+}
+
+// NewCacheRecorder returns a writer that records the response so it can be
+// stored once the pipeline completes, or nil if the request is not
+// cacheable
+func NewCacheRecorder(w http.ResponseWriter, r *http.Request, rules *CacheRules) *CacheRecorder {
+	cache, ok := r.Context().Value(cacheKey).(*Cache)
+	if !ok || (r.Method != "GET" && r.Method != "HEAD") {
+		return nil
+	}
+
+	recorder := &CacheRecorder{
+		ResponseWriter: w,
+		cache:          cache,
+		rules:          rules,
+		PurgeKey:       r.URL.Path,
+	}
+	if rules != nil {
+		recorder.TTL = rules.TTL
+	}
+	return recorder
+}
+
+// Lookup responds from the cache if possible. It is called once the stages
+// before the route's own command have run, so auth and before commands
+// always run. The key includes the environment variables and tags those
+// stages set, so e.g. responses for different users are stored separately.
+func (recorder *CacheRecorder) Lookup(r *http.Request, initial []string, env []string, tags Tags) bool {
+	if recorder.checked {
+		return false
+	}
+	recorder.checked = true
+	recorder.key = CacheKey(r, recorder.rules) + cacheVariant(initial, env, tags)
+
+	if strings.Contains(r.Header.Get("Cache-Control"), "no-cache") {
+		return false
+	}
+
+	entry := recorder.cache.Get(recorder.key)
+	if entry == nil {
+		return false
+	}
+
+	log.Printf("serving cached response for %s", r.URL.Path)
+	entry.Write(recorder.ResponseWriter, r)
+	return true
+}
+
+// cacheVariant describes the changes earlier stages made to the environment
+// and the tags they set
+func cacheVariant(initial []string, env []string, tags Tags) string {
+	before := make(map[string]bool, len(initial))
+	for _, e := range initial {
+		before[e] = true
+	}
+	after := make(map[string]bool, len(env))
+	for _, e := range env {
+		after[e] = true
+	}
+
+	var changes []string
+	for _, e := range env {
+		if !before[e] {
+			changes = append(changes, "+"+e)
+		}
+	}
+	for _, e := range initial {
+		if !after[e] {
+			changes = append(changes, "-"+e)
+		}
+	}
+	for key, values := range tags {
+		changes = append(changes, fmt.Sprintf("%s: %q", key, values))
+	}
+
+	if len(changes) == 0 {
+		return ""
+	}
+	sort.Strings(changes)
+	return "\n" + strings.Join(changes, "\n")
+}
+
+// ApplyCacheTags purges cached responses and configures the recorder, if
+// the response is being recorded, from the cache tags. The tags are removed.
+func ApplyCacheTags(w http.ResponseWriter, r *http.Request, tags Tags) error {
+	if cache, ok := r.Context().Value(cacheKey).(*Cache); ok {
+		for _, pattern := range tags["CACHE_PURGE"] {
+			purged := cache.Purge(pattern)
+			log.Printf("purged %d cached responses for %s", purged, pattern)
+		}
+	}
+
+	if recorder, ok := w.(*CacheRecorder); ok {
+		if values, ok := tags["CACHE_TTL"]; ok {
+			ttl, err := ParseCacheTTL(values[len(values)-1])
+			if err != nil {
+				return err
+			}
+			recorder.TTL = ttl
+		}
+
+		if values, ok := tags["CACHE_KEY"]; ok {
+			recorder.PurgeKey = values[len(values)-1]
+		}
+
+		if values, ok := tags["CACHE_BYPASS"]; ok {
+			bypass, err := strconv.ParseBool(values[len(values)-1])
+			if err != nil {
+				return fmt.Errorf("invalid CACHE_BYPASS value %s", values[len(values)-1])
+			}
+			recorder.Bypass = bypass
+		}
+	}
+
+	for _, tag := range []string{"CACHE_TTL", "CACHE_KEY", "CACHE_BYPASS", "CACHE_PURGE"} {
+		delete(tags, tag)
+	}
+	return nil
+}
+
+// ParseCacheTTL parses a duration such as 30s, or a number of seconds
+func ParseCacheTTL(value string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, nil
+	}
+
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl < 0 {
+		return 0, fmt.Errorf("invalid cache ttl %s", value)
+	}
+	return ttl, nil
+}
+
+// CacheRecorder passes a response through to the client while recording it
+// for the cache
+type CacheRecorder struct {
+	http.ResponseWriter
+	TTL      time.Duration
+	PurgeKey string
+	Bypass   bool
+
+	cache   *Cache
+	rules   *CacheRules
+	key     string
+	checked bool
+	status  int
+	header  http.Header
+	body    bytes.Buffer
+	storing bool
+}
+
+func (recorder *CacheRecorder) WriteHeader(status int) {
+	if recorder.status != 0 {
+		return
+	}
+	recorder.status = status
+
+	header := recorder.Header()
+	cacheControl := header.Get("Cache-Control")
+	recorder.storing = recorder.TTL > 0 && !recorder.Bypass && cacheableStatuses[status] &&
+		len(header["Set-Cookie"]) == 0 &&
+		!strings.Contains(cacheControl, "no-store") && !strings.Contains(cacheControl, "private")
+
+	if recorder.storing {
+		if cacheControl == "" {
+			header.Set("Cache-Control", fmt.Sprintf("max-age=%d", int(recorder.TTL/time.Second)))
+		}
+		header.Set("X-Cache", "MISS")
+		recorder.header = header.Clone()
+		recorder.header.Del("X-Cache")
+		recorder.header.Del(RequestIDHeader)
+	}
+
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *CacheRecorder) Write(b []byte) (int, error) {
+	if recorder.status == 0 {
+		recorder.WriteHeader(http.StatusOK)
+	}
+
+	if recorder.storing {
+		if int64(recorder.body.Len()+len(b)) > recorder.cache.config.MaxEntrySize {
+			recorder.storing = false
+			recorder.body.Reset()
+		} else {
+			recorder.body.Write(b)
+		}
+	}
+
+	return recorder.ResponseWriter.Write(b)
+}
+
+// Store adds the recorded response to the cache if it is cacheable. Responses
+// from pipelines that stopped before the route's own command are not stored.
+func (recorder *CacheRecorder) Store() {
+	if !recorder.storing || !recorder.checked {
+		return
+	}
+
+	now := time.Now()
+	recorder.cache.Set(&CacheEntry{
+		Key:      recorder.key,
+		PurgeKey: recorder.PurgeKey,
+		Status:   recorder.status,
+		Header:   recorder.header,
+		Body:     append([]byte{}, recorder.body.Bytes()...),
+		Stored:   now,
+		Expires:  now.Add(recorder.TTL),
+	})
+}
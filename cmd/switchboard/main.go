@@ -40,6 +40,11 @@ func main() {
 			Usage:  "",
 			Action: switchboard.Routes,
 		},
+		cli.Command{
+			Name:   "openapi",
+			Usage:  "",
+			Action: switchboard.OpenAPI,
+		},
 	}
 
 	app.Action = switchboard.Serve
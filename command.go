@@ -1,55 +1,59 @@
 package switchboard
 
 import (
-	"bufio"
 	"bytes"
 	"io"
-	"log"
+	"log/slog"
 	"regexp"
+	"time"
 )
 
 var (
-	isTag = regexp.MustCompile(`^([A-Z_]+)\:\ (.*)$`)
+	isTag = regexp.MustCompile(`^([A-Z][A-Z0-9_]*)\:\ (.*)$`)
 )
 
 type Command struct {
-	Name    string
-	Command string
-	Driver  Driver
-	Image   string
-	Inline  string
+	Name        string
+	Command     string
+	Driver      Driver
+	Image       string
+	Inline      string
+	Timeout     time.Duration
+	MemoryLimit int
+	Input       string
+	Output      string
 }
 
-func (command *Command) Execute(env []string, stdin io.Reader) (int64, Tags, io.Reader, error) {
+func (command *Command) Execute(logger *slog.Logger, env []string, stdin io.Reader) (int64, Tags, io.Reader, error) {
 	var stdout, stderr bytes.Buffer
 
 	status, err := command.Driver.Execute(command, env, &Streams{stdin, &stdout, &stderr})
+
+	// Output written before a failure is still useful for debugging
+	if lerr := LogStderr(logger, &stderr); lerr != nil && err == nil {
+		err = lerr
+	}
 	if err != nil {
 		return -1, nil, nil, err
 	}
 
-	err = LogStderr(&stderr)
-	if err != nil {
-		return -1, nil, nil, err
+	parse := ParseTags
+	if command.Output == JSONOutput {
+		// A failed command's output is passed on as is, it need not be an
+		// envelope
+		if status != 0 {
+			return status, nil, &stdout, nil
+		}
+		parse = ParseJSONOutput
 	}
 
-	tags, rest, err := ParseTags(&stdout)
+	tags, rest, err := parse(&stdout)
 	if err != nil {
+		if command.Output == JSONOutput {
+			err = &OutputError{Command: command.Name, Err: err}
+		}
 		return -1, nil, nil, err
 	}
 
 	return status, tags, rest, nil
 }
-
-func LogStderr(stderr io.Reader) error {
-	scanner := bufio.NewScanner(stderr)
-	for scanner.Scan() {
-		log.Print(scanner.Text())
-	}
-
-	if err := scanner.Err(); err != nil {
-		return err
-	}
-
-	return nil
-}
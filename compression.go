@@ -0,0 +1,330 @@
+package switchboard
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	DefaultCompressionMinSize     = 1024
+	DefaultCompressionMaxBodySize = 10 * 1024 * 1024
+)
+
+var (
+	errUnsupportedEncoding = errors.New("unsupported content encoding")
+
+	// DefaultCompressionEncodings are in order of preference
+	DefaultCompressionEncodings = []string{"br", "gzip", "deflate"}
+
+	DefaultCompressionTypes = []string{
+		"text/*",
+		"application/json",
+		"application/*+json",
+		"application/javascript",
+		"application/xml",
+		"application/*+xml",
+		"image/svg+xml",
+	}
+)
+
+// CompressionConfig enables response compression. Responses are compressed
+// with the first of the encodings the client accepts with the highest
+// quality, when their Content-Type matches one of the types and the body
+// is at least MinSize bytes. Types may contain wildcards, e.g. text/*.
+//
+// Commands opt out with HTTP_COMPRESS: false, or by setting their own
+// Content-Encoding header.
+//
+// Encoded request bodies are decoded before they reach the route, bodies
+// that decode to more than MaxBodySize bytes respond with 413 Request Entity
+// Too Large.
+type CompressionConfig struct {
+	Encodings   []string
+	Types       []string
+	MinSize     int
+	MaxBodySize int64
+}
+
+type compressionState struct {
+	disabled bool
+}
+
+// DisableCompression stops the response to the request from being
+// compressed
+func DisableCompression(r *http.Request) {
+	if state, ok := r.Context().Value(compressionKey).(*compressionState); ok {
+		state.disabled = true
+	}
+}
+
+// CompressionMiddleware decodes request bodies sent with a gzip, deflate or
+// br Content-Encoding and, when config is set, compresses responses
+func CompressionMiddleware(config *CompressionConfig) func(http.Handler) http.Handler {
+	maxBodySize := int64(DefaultCompressionMaxBodySize)
+	if config != nil && config.MaxBodySize > 0 {
+		maxBodySize = config.MaxBodySize
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if encoding := r.Header.Get("Content-Encoding"); encoding != "" {
+				log.Printf("decoding %s request body", encoding)
+				body, status, err := decodeRequestBody(encoding, r.Body, maxBodySize)
+				if err != nil {
+					log.Printf("failed to decode request body: %s", err)
+					HandleError(w, r, RequestToEnv(r), NewHandlerError(r, status, err, ""))
+					return
+				}
+
+				r.Body = ioutil.NopCloser(bytes.NewReader(body))
+				r.ContentLength = int64(len(body))
+				r.Header.Del("Content-Encoding")
+				r.Header.Del("Content-Length")
+			}
+
+			if config == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			state := &compressionState{}
+			cw := &compressWriter{
+				ResponseWriter: w,
+				config:         config,
+				state:          state,
+				encoding:       NegotiateEncoding(r.Header.Get("Accept-Encoding"), config.Encodings),
+				head:           r.Method == "HEAD",
+			}
+			defer cw.Close()
+
+			ctx := context.WithValue(r.Context(), compressionKey, state)
+			next.ServeHTTP(cw, r.WithContext(ctx))
+		})
+	}
+}
+
+// decodeRequestBody reads the decoded body, or returns the status to respond
+// with when it cannot be decoded
+func decodeRequestBody(encoding string, body io.ReadCloser, maxSize int64) ([]byte, int, error) {
+	reader, err := decodeBody(encoding, body)
+	if err == errUnsupportedEncoding {
+		return nil, http.StatusUnsupportedMediaType, errors.New("unsupported Content-Encoding")
+	} else if err != nil {
+		return nil, http.StatusBadRequest, errors.New("malformed request body")
+	}
+	defer reader.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(reader, maxSize+1))
+	if err != nil {
+		return nil, http.StatusBadRequest, errors.New("malformed request body")
+	}
+	if int64(len(b)) > maxSize {
+		return nil, http.StatusRequestEntityTooLarge, errors.New("request body too large")
+	}
+	return b, 0, nil
+}
+
+func decodeBody(encoding string, body io.ReadCloser) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(body)
+	case "deflate":
+		return zlib.NewReader(body)
+	case "br":
+		return ioutil.NopCloser(brotli.NewReader(body)), nil
+	case "identity":
+		return body, nil
+	}
+	return nil, errUnsupportedEncoding
+}
+
+// NegotiateEncoding picks the encoding for an Accept-Encoding header. The
+// encoding with the highest quality wins, ties go to the earliest of the
+// supported encodings. An empty string means the body is not encoded.
+func NegotiateEncoding(header string, supported []string) string {
+	if header == "" {
+		return ""
+	}
+
+	qualities := make(map[string]float64)
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		qualities[name] = q
+	}
+
+	candidates := make([]string, 0, len(supported))
+	for _, encoding := range supported {
+		q, ok := qualities[encoding]
+		if !ok {
+			q, ok = qualities["*"]
+		}
+		if ok && q > 0 {
+			candidates = append(candidates, encoding)
+		}
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		qi, ok := qualities[candidates[i]]
+		if !ok {
+			qi = qualities["*"]
+		}
+		qj, ok := qualities[candidates[j]]
+		if !ok {
+			qj = qualities["*"]
+		}
+		return qi > qj
+	})
+	return candidates[0]
+}
+
+// compressWriter holds the response until MinSize bytes are written or the
+// response ends, then decides whether to compress it
+type compressWriter struct {
+	http.ResponseWriter
+	config   *CompressionConfig
+	state    *compressionState
+	encoding string
+	head     bool
+
+	status  int
+	buf     []byte
+	decided bool
+	encoder io.WriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status == 0 {
+		cw.status = status
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+
+	if !cw.decided {
+		cw.buf = append(cw.buf, b...)
+		if len(cw.buf) < cw.config.MinSize {
+			return len(b), nil
+		}
+		if err := cw.decide(); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	if cw.encoder != nil {
+		return cw.encoder.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// decide writes the headers and the buffered body, compressing them if the
+// response qualifies
+func (cw *compressWriter) decide() error {
+	cw.decided = true
+	header := cw.Header()
+
+	if header.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		header.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+
+	compressible := !cw.state.disabled &&
+		header.Get("Content-Encoding") == "" &&
+		cw.status >= 200 && cw.status != http.StatusNoContent && cw.status != http.StatusNotModified &&
+		cw.compressibleType(header.Get("Content-Type"))
+
+	if compressible {
+		header.Add("Vary", "Accept-Encoding")
+	}
+
+	if compressible && cw.encoding != "" && len(cw.buf) >= cw.config.MinSize && !cw.head {
+		log.Printf("compressing response with %s", cw.encoding)
+		header.Set("Content-Encoding", cw.encoding)
+		header.Del("Content-Length")
+		if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			header.Set("ETag", "W/"+etag)
+		}
+
+		switch cw.encoding {
+		case "br":
+			cw.encoder = brotli.NewWriter(cw.ResponseWriter)
+		case "gzip":
+			cw.encoder = gzip.NewWriter(cw.ResponseWriter)
+		case "deflate":
+			cw.encoder = zlib.NewWriter(cw.ResponseWriter)
+		}
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	if cw.encoder != nil {
+		_, err := cw.encoder.Write(buf)
+		return err
+	}
+	_, err := cw.ResponseWriter.Write(buf)
+	return err
+}
+
+func (cw *compressWriter) compressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	for _, pattern := range cw.config.Types {
+		if matched, _ := path.Match(strings.ToLower(pattern), mediaType); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Close finishes the response, including responses without a body
+func (cw *compressWriter) Close() error {
+	if !cw.decided {
+		if cw.status == 0 {
+			return nil
+		}
+		if err := cw.decide(); err != nil {
+			return err
+		}
+	}
+
+	if cw.encoder != nil {
+		return cw.encoder.Close()
+	}
+	return nil
+}
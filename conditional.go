@@ -0,0 +1,173 @@
+package switchboard
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	AutoETag = "auto"
+)
+
+// ParseETag returns the entity tag in its header form. Unquoted values are
+// quoted, so both abc and "abc" are accepted, and W/"abc" is a weak tag.
+func ParseETag(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	opaque := strings.TrimPrefix(value, "W/")
+	if len(opaque) >= 2 && strings.HasPrefix(opaque, `"`) && strings.HasSuffix(opaque, `"`) {
+		opaque = opaque[1 : len(opaque)-1]
+	} else if opaque != value {
+		return "", fmt.Errorf("invalid HTTP_ETAG value %s", value)
+	} else {
+		value = `"` + value + `"`
+	}
+
+	for _, c := range opaque {
+		if c == '"' || c <= ' ' || c == 0x7f {
+			return "", fmt.Errorf("invalid HTTP_ETAG value %s", value)
+		}
+	}
+	return value, nil
+}
+
+// ParseLastModified accepts an HTTP date, an RFC 3339 time or a Unix
+// timestamp
+func ParseLastModified(value string) (time.Time, error) {
+	if t, err := http.ParseTime(value); err == nil {
+		return t.UTC(), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC().Truncate(time.Second), nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0).UTC(), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid HTTP_LAST_MODIFIED value %s", value)
+}
+
+// ETagFromBody returns a strong entity tag for the body
+func ETagFromBody(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// CheckPreconditions evaluates the conditional request headers against the
+// entity tag and modification time of a successful response, in the order
+// of RFC 9110. It returns 304 Not Modified, 412 Precondition Failed or 0
+// when the response should be sent. Either validator may be empty.
+func CheckPreconditions(r *http.Request, etag string, lastModified time.Time) int {
+	safe := r.Method == "GET" || r.Method == "HEAD"
+
+	if header := r.Header.Get("If-Match"); header != "" {
+		if !etagListMatches(header, etag, false) {
+			return http.StatusPreconditionFailed
+		}
+	} else if header := r.Header.Get("If-Unmodified-Since"); header != "" && !lastModified.IsZero() {
+		if t, err := http.ParseTime(header); err == nil && lastModified.After(t) {
+			return http.StatusPreconditionFailed
+		}
+	}
+
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		if etagListMatches(header, etag, true) {
+			if safe {
+				return http.StatusNotModified
+			}
+			return http.StatusPreconditionFailed
+		}
+	} else if header := r.Header.Get("If-Modified-Since"); header != "" && safe && !lastModified.IsZero() {
+		if t, err := http.ParseTime(header); err == nil && !lastModified.After(t) {
+			return http.StatusNotModified
+		}
+	}
+
+	return 0
+}
+
+// etagListMatches reports whether the comma separated list of entity tags,
+// or "*", matches etag. Weak comparison ignores the W/ prefix, strong
+// comparison never matches weak tags.
+func etagListMatches(header string, etag string, weak bool) bool {
+	if etag == "" {
+		return false
+	}
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	if !weak && strings.HasPrefix(etag, "W/") {
+		return false
+	}
+
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if weak {
+			if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		} else if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidatorTags parses the HTTP_ETAG and HTTP_LAST_MODIFIED tags, either of
+// which may be missing
+func ValidatorTags(tags Tags) (string, time.Time, error) {
+	var err error
+	etag := ""
+	if values, ok := tags["HTTP_ETAG"]; ok {
+		etag, err = ParseETag(values[len(values)-1])
+		if err != nil {
+			return "", time.Time{}, err
+		}
+	}
+
+	var lastModified time.Time
+	if values, ok := tags["HTTP_LAST_MODIFIED"]; ok {
+		lastModified, err = ParseLastModified(values[len(values)-1])
+		if err != nil {
+			return "", time.Time{}, err
+		}
+	}
+
+	return etag, lastModified, nil
+}
+
+// StagePreconditionFailed reports whether the preconditions of an unsafe
+// request fail against the current version of the resource, as reported by
+// the tags of a stage that runs before the route's command
+func StagePreconditionFailed(r *http.Request, tags Tags) (bool, error) {
+	if r.Method == "GET" || r.Method == "HEAD" {
+		return false, nil
+	}
+
+	etag, lastModified, err := ValidatorTags(tags)
+	if err != nil || (etag == "" && lastModified.IsZero()) {
+		return false, err
+	}
+	return CheckPreconditions(r, etag, lastModified) == http.StatusPreconditionFailed, nil
+}
+
+// AutoETag reports whether a route in the pipeline computes entity tags
+// from response bodies
+func (pipeline Pipeline) AutoETag() bool {
+	for _, route := range pipeline {
+		switch r := route.(type) {
+		case *BasicRoute:
+			if r.ETag == AutoETag {
+				return true
+			}
+		case *ResourceRoute:
+			if r.ETag == AutoETag {
+				return true
+			}
+		}
+	}
+	return false
+}
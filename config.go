@@ -2,6 +2,7 @@ package switchboard
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -9,6 +10,10 @@ import (
 	"os"
 	"path"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/client"
@@ -21,8 +26,11 @@ const (
 
 	DefaultRouteMethod = "GET"
 
+	DefaultResourceParam = "id"
+
 	BasicRouteType    = "basic"
 	ResourceRouteType = "resource"
+	GroupRouteType    = "group"
 	DefaultRouteType  = BasicRouteType
 )
 
@@ -30,30 +38,132 @@ var (
 	onlyAlphanumericRegexp        = regexp.MustCompile("[^a-zA-Z0-9-]")
 	removeSurroundingDashesRegexp = regexp.MustCompile("(^-*)|(-*$)")
 	consolidateDashesRegexp       = regexp.MustCompile("-+")
+
+	errMalformedCommand = errors.New("command malformed")
+
+	DefaultCollectionMethods = []string{"GET", "POST"}
+	DefaultMemberMethods     = []string{"GET", "PUT", "PATCH", "DELETE"}
 )
 
 type Config struct {
-	Commands map[string]*Command
-	Routes   map[string]Route
+	Commands      map[string]*Command
+	Routes        []Route
+	ErrorHandlers ErrorHandlers
+	OpenAPI       OpenAPIConfig
+	Cache         CacheConfig
+	Compression   *CompressionConfig
 }
 
 type ConfigYAML struct {
-	Commands map[string]*CommandYAML `yaml:"commands"`
-	Routes   map[string]*RouteYAML   `yaml:"routes"`
+	Commands         map[string]*CommandYAML `yaml:"commands"`
+	Routes           RoutesYAML              `yaml:"routes"`
+	NotFound         interface{}             `yaml:"not_found"`
+	MethodNotAllowed interface{}             `yaml:"method_not_allowed"`
+	Error            interface{}             `yaml:"error"`
+	OpenAPI          *OpenAPIYAML            `yaml:"openapi"`
+	Cache            *CacheConfigYAML        `yaml:"cache"`
+	Compression      *CompressionYAML        `yaml:"compression"`
+}
+
+type CompressionYAML struct {
+	Encodings   []string `yaml:"encodings"`
+	Types       []string `yaml:"types"`
+	MinSize     *int     `yaml:"min_size"`
+	MaxBodySize int64    `yaml:"max_body_size"`
+}
+
+type CacheConfigYAML struct {
+	MaxEntries   int    `yaml:"max_entries"`
+	MaxSize      int64  `yaml:"max_size"`
+	MaxEntrySize int64  `yaml:"max_entry_size"`
+	Dir          string `yaml:"dir"`
+}
+
+type OpenAPIYAML struct {
+	Title   string `yaml:"title"`
+	Version string `yaml:"version"`
+	Serve   bool   `yaml:"serve"`
+	Path    string `yaml:"path"`
 }
 
 type CommandYAML struct {
-	Command string `yaml:"command"`
-	Driver  string `yaml:"driver"`
-	Image   string `yaml:"image"`
-	Inline  string `yaml:"inline"`
+	Command     string `yaml:"command"`
+	Driver      string `yaml:"driver"`
+	Image       string `yaml:"image"`
+	Inline      string `yaml:"inline"`
+	Timeout     string `yaml:"timeout"`
+	MemoryLimit string `yaml:"memory_limit"`
+	Input       string `yaml:"input"`
+	Output      string `yaml:"output"`
 }
 
 type RouteYAML struct {
-	Command interface{}           `yaml:"command"`
-	Method  interface{}           `yaml:"method"`
-	Type    string                `yaml:"type"`
-	Routes  map[string]*RouteYAML `yaml:"routes"`
+	Command           interface{}            `yaml:"command"`
+	Method            interface{}            `yaml:"method"`
+	Methods           map[string]interface{} `yaml:"methods"`
+	Auth              interface{}            `yaml:"auth"`
+	Before            []interface{}          `yaml:"before"`
+	After             []interface{}          `yaml:"after"`
+	Parallel          yaml.MapSlice          `yaml:"parallel"`
+	Merge             string                 `yaml:"merge"`
+	Env               map[string]string      `yaml:"env"`
+	Timeout           string                 `yaml:"timeout"`
+	Driver            string                 `yaml:"driver"`
+	Type              string                 `yaml:"type"`
+	Priority          int                    `yaml:"priority"`
+	Host              string                 `yaml:"host"`
+	Schemes           []string               `yaml:"schemes"`
+	Headers           map[string]string      `yaml:"headers"`
+	Queries           map[string]string      `yaml:"queries"`
+	Param             string                 `yaml:"param"`
+	Pattern           string                 `yaml:"pattern"`
+	NestedParam       string                 `yaml:"nested_param"`
+	CollectionMethods []string               `yaml:"collection_methods"`
+	MemberMethods     []string               `yaml:"member_methods"`
+	Collection        RoutesYAML             `yaml:"collection"`
+	Member            RoutesYAML             `yaml:"member"`
+	Routes            RoutesYAML             `yaml:"routes"`
+	Summary           string                 `yaml:"summary"`
+	Description       string                 `yaml:"description"`
+	RequestBody       *BodyDocs              `yaml:"request_body"`
+	Responses         map[string]*BodyDocs   `yaml:"responses"`
+	Request           *RequestYAML           `yaml:"request"`
+	Cache             *CacheYAML             `yaml:"cache"`
+	ETag              string                 `yaml:"etag"`
+	Form              *FormYAML              `yaml:"form"`
+}
+
+type FormYAML struct {
+	Multipart  bool  `yaml:"multipart"`
+	URLEncoded bool  `yaml:"urlencoded"`
+	MaxSize    int64 `yaml:"max_size"`
+	MaxFiles   int   `yaml:"max_files"`
+}
+
+type CacheYAML struct {
+	TTL     string   `yaml:"ttl"`
+	Query   []string `yaml:"query"`
+	Headers []string `yaml:"headers"`
+}
+
+type RequestYAML struct {
+	Schema       interface{}            `yaml:"schema"`
+	Headers      []string               `yaml:"headers"`
+	ContentTypes []string               `yaml:"content_types"`
+	Query        map[string]interface{} `yaml:"query"`
+	Params       map[string]string      `yaml:"params"`
+	MaxBodySize  int64                  `yaml:"max_body_size"`
+}
+
+// RoutesYAML is an ordered set of routes keyed by path. Routes keep the order
+// they are defined in the config file, which is the order they are matched
+// in, unless a route sets a priority. Routes with a higher priority are
+// matched before their siblings.
+type RoutesYAML []RouteYAMLEntry
+
+type RouteYAMLEntry struct {
+	Path  string
+	Route *RouteYAML
 }
 
 func ParseConfig(r io.Reader) (*Config, error) {
@@ -79,7 +189,7 @@ func ParseConfig(r io.Reader) (*Config, error) {
 func (configYAML *ConfigYAML) ToConfig() (*Config, error) {
 	config := &Config{
 		Commands: make(map[string]*Command),
-		Routes:   make(map[string]Route),
+		Routes:   make([]Route, 0, len(configYAML.Routes)),
 	}
 
 	for name, commandYAML := range configYAML.Commands {
@@ -91,13 +201,65 @@ func (configYAML *ConfigYAML) ToConfig() (*Config, error) {
 		config.Commands[name] = command
 	}
 
-	for path, routeYAML := range configYAML.Routes {
-		route, err := routeYAML.ToRoute(path, config.Commands)
+	for _, entry := range configYAML.Routes.Sorted() {
+		route, err := entry.Route.ToRoute(entry.Path, config.Commands)
 		if err != nil {
 			return nil, err
 		}
 
-		config.Routes[path] = route
+		config.Routes = append(config.Routes, route)
+	}
+
+	for _, handler := range []struct {
+		name    string
+		value   interface{}
+		command **Command
+	}{
+		{"not_found", configYAML.NotFound, &config.ErrorHandlers.NotFound},
+		{"method_not_allowed", configYAML.MethodNotAllowed, &config.ErrorHandlers.MethodNotAllowed},
+		{"error", configYAML.Error, &config.ErrorHandlers.Error},
+	} {
+		command, err := ParseRouteCommand(handler.value, PathToName(handler.name), config.Commands, RouteSettings{})
+		if err == errMalformedCommand {
+			return nil, fmt.Errorf("command malformed for %s handler", handler.name)
+		} else if err != nil {
+			return nil, err
+		}
+		*handler.command = command
+	}
+
+	if configYAML.OpenAPI != nil {
+		config.OpenAPI = OpenAPIConfig{
+			Title:   configYAML.OpenAPI.Title,
+			Version: configYAML.OpenAPI.Version,
+		}
+
+		if configYAML.OpenAPI.Serve {
+			config.OpenAPI.Path = configYAML.OpenAPI.Path
+			if config.OpenAPI.Path == "" {
+				config.OpenAPI.Path = DefaultOpenAPIPath
+			}
+		}
+	}
+
+	if configYAML.Cache != nil {
+		if configYAML.Cache.MaxEntries < 0 || configYAML.Cache.MaxSize < 0 || configYAML.Cache.MaxEntrySize < 0 {
+			return nil, errors.New("cache limits must not be negative")
+		}
+		config.Cache = CacheConfig{
+			MaxEntries:   configYAML.Cache.MaxEntries,
+			MaxSize:      configYAML.Cache.MaxSize,
+			MaxEntrySize: configYAML.Cache.MaxEntrySize,
+			Dir:          configYAML.Cache.Dir,
+		}
+	}
+
+	if configYAML.Compression != nil {
+		compression, err := configYAML.Compression.ToConfig()
+		if err != nil {
+			return nil, err
+		}
+		config.Compression = compression
 	}
 
 	return config, nil
@@ -126,6 +288,51 @@ func (commandYAML *CommandYAML) ToCommand(name string) (*Command, error) {
 	command.Command = commandYAML.Command
 	command.Image = commandYAML.Image
 	command.Inline = commandYAML.Inline
+	command.Input = commandYAML.Input
+	command.Output = commandYAML.Output
+
+	switch command.Input {
+	case "":
+		command.Input = DefaultInput
+	case RawInput, JSONInput:
+	default:
+		return nil, fmt.Errorf("unsupported input \"%s\" for command \"%s\"", command.Input, name)
+	}
+
+	switch command.Output {
+	case "":
+		command.Output = DefaultOutput
+	case TagsOutput, JSONOutput:
+	default:
+		return nil, fmt.Errorf("unsupported output \"%s\" for command \"%s\"", command.Output, name)
+	}
+
+	if commandYAML.Timeout != "" {
+		timeout, err := time.ParseDuration(commandYAML.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout for command \"%s\": %s", name, err)
+		}
+		command.Timeout = timeout
+	}
+
+	if commandYAML.MemoryLimit != "" {
+		limit, err := strconv.Atoi(commandYAML.MemoryLimit)
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid memory_limit for command \"%s\"", name)
+		}
+		command.MemoryLimit = limit
+	}
+
+	if driverName == "lua" {
+		if command.Inline == "" {
+			return nil, fmt.Errorf("lua command \"%s\" requires an inline script", name)
+		}
+
+		_, err := DefaultLuaDriver.Compile(name, command.Inline)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	if driverName == "docker" {
 		cli, err := client.NewEnvClient()
@@ -146,101 +353,255 @@ func (commandYAML *CommandYAML) ToCommand(name string) (*Command, error) {
 }
 
 func (routeYAML *RouteYAML) ToRoute(path string, commands map[string]*Command) (Route, error) {
-	var command *Command
+	return routeYAML.toRoute(path, commands, nil, RouteSettings{})
+}
+
+// toRoute converts the route, falling back to defaultCommand when the route
+// does not specify a command. This is used for resource actions which reuse
+// the resource command unless they provide their own. Settings inherited from
+// parent routes are resolved here.
+func (routeYAML *RouteYAML) toRoute(path string, commands map[string]*Command, defaultCommand *Command, parentSettings RouteSettings) (Route, error) {
 	malformedErr := fmt.Errorf("command malformed for route \"%s\"", path)
 
-	switch c := routeYAML.Command.(type) {
-	case string:
-		var ok bool
-		command, ok = commands[c]
-		if !ok {
-			return nil, fmt.Errorf("command \"%s\" not found", c)
+	settings, err := parentSettings.Inherit(routeYAML)
+	if err != nil {
+		return nil, fmt.Errorf("%s for route \"%s\"", err, path)
+	}
+
+	command, err := ParseRouteCommand(routeYAML.Command, PathToName(path), commands, settings)
+	if err == errMalformedCommand {
+		return nil, malformedErr
+	} else if err != nil {
+		return nil, err
+	}
+
+	if command == nil {
+		command = settings.Apply(defaultCommand)
+	}
+
+	handlers := make(map[string]*Command)
+	for method, value := range routeYAML.Methods {
+		method = strings.ToUpper(method)
+		name := PathToName(fmt.Sprintf("%s-%s", path, method))
+		handler, err := ParseRouteCommand(value, name, commands, settings)
+		if err == errMalformedCommand || handler == nil {
+			return nil, fmt.Errorf("command malformed for %s on route \"%s\"", method, path)
+		} else if err != nil {
+			return nil, err
 		}
-	case map[interface{}]interface{}:
-		cs := make(map[string]string)
-		for k, v := range c {
-			ks, ok := k.(string)
+		handlers[method] = handler
+	}
+
+	routeType := routeYAML.Type
+	if routeType == "" {
+		routeType = DefaultRouteType
+	}
+
+	var parallel *Parallel
+	if len(routeYAML.Parallel) > 0 {
+		if command != nil || routeType != BasicRouteType {
+			return nil, fmt.Errorf("parallel route \"%s\" cannot have a command or type", path)
+		}
+
+		parallel = &Parallel{Merge: routeYAML.Merge}
+		if parallel.Merge == "" {
+			parallel.Merge = DefaultMerge
+		}
+
+		switch parallel.Merge {
+		case JSONMerge, ConcatMerge, FirstMerge:
+		default:
+			return nil, fmt.Errorf("unsupported merge strategy \"%s\" for route \"%s\"", parallel.Merge, path)
+		}
+
+		for _, item := range routeYAML.Parallel {
+			name, ok := item.Key.(string)
 			if !ok {
 				return nil, malformedErr
 			}
 
-			vs, ok := v.(string)
-			if !ok {
-				return nil, malformedErr
+			parallelCommand, err := ParseRouteCommand(item.Value, PathToName(fmt.Sprintf("%s-%s", path, name)), commands, settings)
+			if err == errMalformedCommand || parallelCommand == nil {
+				return nil, fmt.Errorf("command malformed for %s on route \"%s\"", name, path)
+			} else if err != nil {
+				return nil, err
 			}
 
-			cs[ks] = vs
+			parallel.Names = append(parallel.Names, name)
+			parallel.Commands = append(parallel.Commands, parallelCommand)
 		}
+	}
 
-		commandYAML := CommandYAML{
-			Command: cs["command"],
-			Driver:  cs["driver"],
-			Image:   cs["image"],
-			Inline:  cs["inline"],
-		}
+	if command == nil && parallel == nil && len(handlers) == 0 && routeType != GroupRouteType {
+		return nil, malformedErr
+	}
 
-		name := PathToName(path)
-		var err error
-		command, err = commandYAML.ToCommand(name)
+	beforeCommands, err := parseRouteCommands(routeYAML.Before, path, "before", commands, settings)
+	if err != nil {
+		return nil, err
+	}
+
+	if routeYAML.Auth != nil {
+		authCommands, err := parseRouteCommands([]interface{}{routeYAML.Auth}, path, "auth", commands, settings)
 		if err != nil {
 			return nil, err
 		}
-	default:
-		return nil, malformedErr
+		beforeCommands = append(authCommands, beforeCommands...)
+		settings.Auth = append(append([]string{}, settings.Auth...), authCommands[0].Name)
 	}
 
-	routeType := routeYAML.Type
-	if routeType == "" {
-		routeType = DefaultRouteType
+	afterCommands, err := parseRouteCommands(routeYAML.After, path, "after", commands, settings)
+	if err != nil {
+		return nil, err
+	}
+
+	docs, err := routeYAML.ToDocs()
+	if err != nil {
+		return nil, fmt.Errorf("%s for route \"%s\"", err, path)
+	}
+
+	request, err := routeYAML.Request.ToRules()
+	if err != nil {
+		return nil, fmt.Errorf("%s for route \"%s\"", err, path)
+	}
+
+	cache, err := routeYAML.Cache.ToRules()
+	if err != nil {
+		return nil, fmt.Errorf("%s for route \"%s\"", err, path)
+	}
+
+	form, err := routeYAML.Form.ToRules()
+	if err != nil {
+		return nil, fmt.Errorf("%s for route \"%s\"", err, path)
+	}
+
+	if routeYAML.ETag != "" && routeYAML.ETag != AutoETag {
+		return nil, fmt.Errorf("unsupported etag \"%s\" for route \"%s\"", routeYAML.ETag, path)
+	}
+
+	matchers := Matchers{
+		Host:    routeYAML.Host,
+		Schemes: routeYAML.Schemes,
+		Headers: routeYAML.Headers,
+		Queries: routeYAML.Queries,
 	}
 
 	switch routeType {
-	case BasicRouteType:
+	case BasicRouteType, GroupRouteType:
+		if routeType == GroupRouteType && (len(routeYAML.Routes) == 0 || len(handlers) > 0) {
+			return nil, fmt.Errorf("group route \"%s\" requires routes and does not support methods", path)
+		}
+
 		route := &BasicRoute{
-			Path:    path,
-			Command: command,
+			Path:           path,
+			Command:        command,
+			Handlers:       handlers,
+			Parallel:       parallel,
+			BeforeCommands: beforeCommands,
+			AfterCommands:  afterCommands,
+			Matchers:       matchers,
+			Settings:       settings,
+			Docs:           docs,
+			Request:        request,
+			Cache:          cache,
+			ETag:           routeYAML.ETag,
+			Form:           form,
 		}
 
-		switch method := routeYAML.Method.(type) {
-		case string:
-			route.Methods = []string{method}
-		case []interface{}:
-			methods := make([]string, len(method))
-			for i, m := range method {
-				methods[i] = m.(string)
-			}
-			route.Methods = methods
-		default:
+		if settings.Methods != nil {
+			route.Methods = settings.Methods
+		} else if len(handlers) == 0 {
 			route.Methods = []string{DefaultRouteMethod}
 		}
 
-		route.Routes = make(map[string]Route)
-		for childPath, childRouteYAML := range routeYAML.Routes {
-			path := JoinPaths("/", path, childPath)
-			fmt.Printf("%s\n", path)
-			r, err := childRouteYAML.ToRoute(path, commands)
+		// Only groups pass their methods on to child routes
+		if routeType != GroupRouteType {
+			settings.Methods = parentSettings.Methods
+		}
+
+		route.Routes = make([]Route, 0, len(routeYAML.Routes))
+		for _, child := range routeYAML.Routes.Sorted() {
+			path := JoinPaths("/", path, child.Path)
+			r, err := child.Route.toRoute(path, commands, nil, settings)
 			if err != nil {
 				return nil, err
 			}
-			route.Routes[childPath] = r
+			route.Routes = append(route.Routes, r)
 		}
 
 		return route, nil
 	case ResourceRouteType:
+		if command == nil || len(handlers) > 0 {
+			return nil, fmt.Errorf("resource route \"%s\" requires a command and does not support methods", path)
+		}
+
 		route := &ResourceRoute{
-			Path:    path,
-			Command: command,
+			Path:              path,
+			Command:           command,
+			BeforeCommands:    beforeCommands,
+			AfterCommands:     afterCommands,
+			Matchers:          matchers,
+			Settings:          settings,
+			Docs:              docs,
+			Request:           request,
+			Cache:             cache,
+			ETag:              routeYAML.ETag,
+			Form:              form,
+			Param:             routeYAML.Param,
+			Pattern:           routeYAML.Pattern,
+			NestedParam:       routeYAML.NestedParam,
+			CollectionMethods: routeYAML.CollectionMethods,
+			MemberMethods:     routeYAML.MemberMethods,
+		}
+
+		if route.Param == "" {
+			route.Param = DefaultResourceParam
+		}
+		if route.NestedParam == "" {
+			route.NestedParam = ResourceParamName(path)
+		}
+		if route.CollectionMethods == nil {
+			route.CollectionMethods = DefaultCollectionMethods
+		}
+		if route.MemberMethods == nil {
+			route.MemberMethods = DefaultMemberMethods
+		}
+
+		if route.Param == route.NestedParam {
+			return nil, fmt.Errorf("param and nested_param must differ for resource route \"%s\"", path)
+		}
+
+		// Resource methods are not inherited by actions and child routes
+		settings.Methods = parentSettings.Methods
+
+		route.Collection = make([]Route, 0, len(routeYAML.Collection))
+		for _, action := range routeYAML.Collection.Sorted() {
+			path := JoinPaths("/", route.Path, action.Path)
+			r, err := action.Route.toRoute(path, commands, command, settings)
+			if err != nil {
+				return nil, err
+			}
+			route.Collection = append(route.Collection, r)
+		}
+
+		route.Member = make([]Route, 0, len(routeYAML.Member))
+		for _, action := range routeYAML.Member.Sorted() {
+			path := JoinPaths("/", route.MemberPath(), action.Path)
+			r, err := action.Route.toRoute(path, commands, command, settings)
+			if err != nil {
+				return nil, err
+			}
+			route.Member = append(route.Member, r)
 		}
 
-		route.Routes = make(map[string]Route)
-		for childPath, childRouteYAML := range routeYAML.Routes {
-			path := JoinPaths("/", path, ":id", childPath)
-			fmt.Printf("%s\n", path)
-			r, err := childRouteYAML.ToRoute(path, commands)
+		route.Routes = make([]Route, 0, len(routeYAML.Routes))
+		for _, child := range routeYAML.Routes.Sorted() {
+			path := JoinPaths("/", route.NestedPath(), child.Path)
+			r, err := child.Route.toRoute(path, commands, nil, settings)
 			if err != nil {
 				return nil, err
 			}
-			route.Routes[childPath] = r
+			route.Routes = append(route.Routes, r)
 		}
 
 		return route, nil
@@ -250,6 +611,324 @@ func (routeYAML *RouteYAML) ToRoute(path string, commands map[string]*Command) (
 	}
 }
 
+// ToDocs converts the route's documentation, schemas and examples are
+// converted so they can be encoded as JSON
+func (routeYAML *RouteYAML) ToDocs() (RouteDocs, error) {
+	docs := RouteDocs{
+		Summary:     routeYAML.Summary,
+		Description: routeYAML.Description,
+	}
+
+	var bodies []*BodyDocs
+	if routeYAML.RequestBody != nil {
+		docs.RequestBody = &BodyDocs{}
+		*docs.RequestBody = *routeYAML.RequestBody
+		bodies = append(bodies, docs.RequestBody)
+	}
+
+	if len(routeYAML.Responses) > 0 {
+		docs.Responses = make(map[string]*BodyDocs, len(routeYAML.Responses))
+		for code, response := range routeYAML.Responses {
+			body := &BodyDocs{}
+			if response != nil {
+				*body = *response
+			}
+			docs.Responses[code] = body
+			bodies = append(bodies, body)
+		}
+	}
+
+	for _, body := range bodies {
+		var err error
+		body.Schema, err = JSONValue(body.Schema)
+		if err != nil {
+			return docs, fmt.Errorf("invalid schema: %s", err)
+		}
+		body.Example, err = JSONValue(body.Example)
+		if err != nil {
+			return docs, fmt.Errorf("invalid example: %s", err)
+		}
+	}
+
+	return docs, nil
+}
+
+// ToRules converts the route's request rules, a query parameter is either
+// a type or a map with a type and whether it is required
+func (requestYAML *RequestYAML) ToRules() (*RequestRules, error) {
+	if requestYAML == nil {
+		return nil, nil
+	}
+
+	rules := &RequestRules{
+		Headers:      requestYAML.Headers,
+		ContentTypes: requestYAML.ContentTypes,
+		Query:        make(map[string]QueryRule),
+		Params:       make(map[string]*regexp.Regexp),
+		MaxBodySize:  requestYAML.MaxBodySize,
+	}
+
+	if rules.MaxBodySize < 0 {
+		return nil, errors.New("request max_body_size must not be negative")
+	} else if rules.MaxBodySize == 0 {
+		rules.MaxBodySize = DefaultRequestMaxBodySize
+	}
+
+	for name, value := range requestYAML.Query {
+		rule := QueryRule{Type: StringQueryType}
+		switch v := value.(type) {
+		case string:
+			rule.Type = v
+		case map[interface{}]interface{}:
+			if t, ok := v["type"].(string); ok {
+				rule.Type = t
+			}
+			rule.Required, _ = v["required"].(bool)
+		case nil:
+		default:
+			return nil, fmt.Errorf("invalid rule for query parameter \"%s\"", name)
+		}
+
+		switch rule.Type {
+		case StringQueryType, IntegerQueryType, NumberQueryType, BooleanQueryType:
+		default:
+			return nil, fmt.Errorf("unsupported type \"%s\" for query parameter \"%s\"", rule.Type, name)
+		}
+		rules.Query[name] = rule
+	}
+
+	for name, pattern := range requestYAML.Params {
+		re, err := regexp.Compile(fmt.Sprintf("^(?:%s)$", pattern))
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern for param \"%s\": %s", name, err)
+		}
+		rules.Params[name] = re
+	}
+
+	if requestYAML.Schema != nil {
+		source, err := JSONValue(requestYAML.Schema)
+		if err != nil {
+			return nil, fmt.Errorf("invalid request schema: %s", err)
+		}
+
+		schema, err := NewSchema(source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid request schema: %s", err)
+		}
+		rules.Schema = schema
+		rules.SchemaSource = source
+	}
+
+	return rules, nil
+}
+
+func (compressionYAML *CompressionYAML) ToConfig() (*CompressionConfig, error) {
+	config := &CompressionConfig{
+		Encodings: compressionYAML.Encodings,
+		Types:     compressionYAML.Types,
+		MinSize:   DefaultCompressionMinSize,
+	}
+
+	if len(config.Encodings) == 0 {
+		config.Encodings = DefaultCompressionEncodings
+	}
+	for _, encoding := range config.Encodings {
+		switch encoding {
+		case "br", "gzip", "deflate":
+		default:
+			return nil, fmt.Errorf("unsupported compression encoding \"%s\"", encoding)
+		}
+	}
+
+	if len(config.Types) == 0 {
+		config.Types = DefaultCompressionTypes
+	}
+	for _, t := range config.Types {
+		if _, err := path.Match(t, ""); err != nil {
+			return nil, fmt.Errorf("invalid compression type \"%s\"", t)
+		}
+	}
+
+	if compressionYAML.MinSize != nil {
+		if *compressionYAML.MinSize < 0 {
+			return nil, errors.New("compression min_size must not be negative")
+		}
+		config.MinSize = *compressionYAML.MinSize
+	}
+
+	if compressionYAML.MaxBodySize < 0 {
+		return nil, errors.New("compression max_body_size must not be negative")
+	}
+	config.MaxBodySize = compressionYAML.MaxBodySize
+	if config.MaxBodySize == 0 {
+		config.MaxBodySize = DefaultCompressionMaxBodySize
+	}
+
+	return config, nil
+}
+
+// ToRules converts the route's cache settings, the ttl is a duration or a
+// number of seconds
+func (cacheYAML *CacheYAML) ToRules() (*CacheRules, error) {
+	if cacheYAML == nil {
+		return nil, nil
+	}
+
+	ttl, err := ParseCacheTTL(cacheYAML.TTL)
+	if err != nil || ttl == 0 {
+		return nil, fmt.Errorf("invalid cache ttl \"%s\"", cacheYAML.TTL)
+	}
+
+	return &CacheRules{
+		TTL:     ttl,
+		Query:   cacheYAML.Query,
+		Headers: cacheYAML.Headers,
+	}, nil
+}
+
+// ToRules converts the route's form settings, limits default to
+// DefaultFormMaxSize and DefaultFormMaxFiles
+func (formYAML *FormYAML) ToRules() (*FormRules, error) {
+	if formYAML == nil {
+		return nil, nil
+	}
+
+	if formYAML.MaxSize < 0 || formYAML.MaxFiles < 0 {
+		return nil, errors.New("form limits must not be negative")
+	}
+
+	rules := &FormRules{
+		Multipart:  formYAML.Multipart,
+		URLEncoded: formYAML.URLEncoded,
+		MaxSize:    formYAML.MaxSize,
+		MaxFiles:   formYAML.MaxFiles,
+	}
+	if rules.MaxSize == 0 {
+		rules.MaxSize = DefaultFormMaxSize
+	}
+	if rules.MaxFiles == 0 {
+		rules.MaxFiles = DefaultFormMaxFiles
+	}
+	return rules, nil
+}
+
+func parseRouteCommands(values []interface{}, path string, kind string, commands map[string]*Command, settings RouteSettings) ([]*Command, error) {
+	parsed := make([]*Command, len(values))
+	for i, value := range values {
+		name := PathToName(fmt.Sprintf("%s-%s-%d", path, kind, i))
+		command, err := ParseRouteCommand(value, name, commands, settings)
+		if err == errMalformedCommand || command == nil {
+			return nil, fmt.Errorf("%s command malformed for route \"%s\"", kind, path)
+		} else if err != nil {
+			return nil, err
+		}
+		parsed[i] = command
+	}
+	return parsed, nil
+}
+
+func (routes *RoutesYAML) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var items yaml.MapSlice
+	err := unmarshal(&items)
+	if err != nil {
+		return err
+	}
+
+	*routes = make(RoutesYAML, 0, len(items))
+	for _, item := range items {
+		path, ok := item.Key.(string)
+		if !ok {
+			return fmt.Errorf("route path %v must be a string", item.Key)
+		}
+
+		// Decode the value again now that the key order is known
+		b, err := yaml.Marshal(item.Value)
+		if err != nil {
+			return err
+		}
+
+		routeYAML := &RouteYAML{}
+		err = yaml.Unmarshal(b, routeYAML)
+		if err != nil {
+			return err
+		}
+
+		*routes = append(*routes, RouteYAMLEntry{Path: path, Route: routeYAML})
+	}
+
+	return nil
+}
+
+// Sorted returns the routes ordered by priority, routes with the same
+// priority keep the order they were defined in.
+func (routes RoutesYAML) Sorted() RoutesYAML {
+	sorted := make(RoutesYAML, len(routes))
+	copy(sorted, routes)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Route.Priority > sorted[j].Route.Priority
+	})
+	return sorted
+}
+
+// ParseRouteCommand looks up a command by name or builds an inline command
+// from a route's command settings. A nil command is returned if value is nil.
+func ParseRouteCommand(value interface{}, name string, commands map[string]*Command, settings RouteSettings) (*Command, error) {
+	switch c := value.(type) {
+	case string:
+		command, ok := commands[c]
+		if !ok {
+			return nil, fmt.Errorf("command \"%s\" not found", c)
+		}
+		return settings.Apply(command), nil
+	case yaml.MapSlice:
+		m := make(map[interface{}]interface{}, len(c))
+		for _, item := range c {
+			m[item.Key] = item.Value
+		}
+		return ParseRouteCommand(m, name, commands, settings)
+	case map[interface{}]interface{}:
+		cs := make(map[string]string)
+		for k, v := range c {
+			ks, ok := k.(string)
+			if !ok {
+				return nil, errMalformedCommand
+			}
+
+			vs, ok := v.(string)
+			if !ok {
+				return nil, errMalformedCommand
+			}
+
+			cs[ks] = vs
+		}
+
+		commandYAML := CommandYAML{
+			Command:     cs["command"],
+			Driver:      cs["driver"],
+			Image:       cs["image"],
+			Inline:      cs["inline"],
+			Timeout:     cs["timeout"],
+			MemoryLimit: cs["memory_limit"],
+			Input:       cs["input"],
+			Output:      cs["output"],
+		}
+
+		if commandYAML.Driver == "" && commandYAML.Image == "" {
+			commandYAML.Driver = settings.Driver
+		}
+
+		command, err := commandYAML.ToCommand(name)
+		if err != nil {
+			return nil, err
+		}
+		return settings.Apply(command), nil
+	case nil:
+		return nil, nil
+	default:
+		return nil, errMalformedCommand
+	}
+}
+
 func ReadConfig(path string) (*Config, error) {
 	file, err := os.Open(path)
 	if err != nil {
@@ -277,6 +956,23 @@ func JoinPaths(paths ...string) string {
 	return path.Join(segments...)
 }
 
+// ResourceParamName derives the variable name used for a resource's id when
+// child routes are nested beneath it, e.g. "/users" becomes "user_id".
+func ResourceParamName(resourcePath string) string {
+	name := PathToName(path.Base(resourcePath))
+	name = strings.Replace(name, "-", "_", -1)
+	name = strings.ToLower(name)
+
+	switch {
+	case strings.HasSuffix(name, "ies"):
+		name = strings.TrimSuffix(name, "ies") + "y"
+	case strings.HasSuffix(name, "s") && !strings.HasSuffix(name, "ss"):
+		name = strings.TrimSuffix(name, "s")
+	}
+
+	return fmt.Sprintf("%s_%s", name, DefaultResourceParam)
+}
+
 func PathToName(path string) string {
 	name := path
 	name = onlyAlphanumericRegexp.ReplaceAllString(name, "-")
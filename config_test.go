@@ -19,7 +19,7 @@ var (
 	configTests = []struct {
 		body     string
 		commands map[string]*switchboard.Command
-		routes   map[string]switchboard.Route
+		routes   []switchboard.Route
 	}{
 		{
 			body: `
@@ -32,8 +32,8 @@ routes:
 			commands: map[string]*switchboard.Command{
 				"hello": helloCommand,
 			},
-			routes: map[string]switchboard.Route{
-				"/hello": &switchboard.BasicRoute{
+			routes: []switchboard.Route{
+				&switchboard.BasicRoute{
 					Path:    "/hello",
 					Command: helloCommand,
 					Methods: []string{"GET"},
@@ -76,11 +76,8 @@ func TestParseConfig(t *testing.T) {
 			t.Fatalf("expected %d routes, got %d routes", 1, len(routes))
 		}
 
-		for path, tiroute := range test.routes {
-			iroute, ok := routes[path]
-			if !ok {
-				t.Fatal("route %s not found", path)
-			}
+		for i, tiroute := range test.routes {
+			iroute := routes[i]
 			route, ok := iroute.(*switchboard.BasicRoute)
 			if !ok {
 				t.Fatal("iroute is not a basic route")
@@ -98,3 +95,44 @@ func TestParseConfig(t *testing.T) {
 		}
 	}
 }
+
+func TestParseConfigRouteOrder(t *testing.T) {
+	body := strings.Replace(`
+commands:
+	hello:
+		command: "echo hello"
+routes:
+	"/c":
+		command: hello
+	"/a":
+		command: hello
+	"/b":
+		command: hello
+		priority: 1
+		routes:
+			"/z":
+				command: hello
+			"/y":
+				command: hello`, "\t", "  ", -1)
+
+	for i := 0; i < 10; i++ {
+		config, err := switchboard.ParseConfig(strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("ParseConfig returned an error: %s", err)
+		}
+
+		var paths []string
+		for _, iroute := range config.Routes {
+			route := iroute.(*switchboard.BasicRoute)
+			paths = append(paths, route.Path)
+			for _, ichild := range route.Routes {
+				paths = append(paths, ichild.(*switchboard.BasicRoute).Path)
+			}
+		}
+
+		expected := "/b /b/z /b/y /c /a"
+		if strings.Join(paths, " ") != expected {
+			t.Fatalf("expected routes in order %s, got %s", expected, strings.Join(paths, " "))
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package switchboard
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	DuplicateConflict = "duplicate"
+	ShadowedConflict  = "shadowed"
+)
+
+var (
+	routeVariableRegexp = regexp.MustCompile(`\{([^{}:]+)(?::((?:[^{}]|\{[^{}]*\})*))?\}`)
+)
+
+// Endpoint is a route attached to the router along with the pipeline that
+// handles it. Endpoints are listed in the order they are matched.
+type Endpoint struct {
+	Host     string
+	Path     string
+	Methods  []string
+	Queries  []string
+	Pipeline Pipeline
+	route    *mux.Route
+}
+
+func (endpoint Endpoint) String() string {
+	s := endpoint.Host + endpoint.Path
+	if len(endpoint.Queries) > 0 {
+		s += "?" + strings.Join(endpoint.Queries, "&")
+	}
+	return s
+}
+
+// Conflict describes an endpoint that can never, or only sometimes, be
+// reached because an endpoint attached before it matches the same requests.
+type Conflict struct {
+	Kind     string
+	Method   string
+	Path     string
+	Shadowed Endpoint
+	By       Endpoint
+}
+
+func (conflict Conflict) String() string {
+	format := "%s %s is shadowed by %s"
+	if conflict.Kind == DuplicateConflict {
+		format = "%s %s duplicates %s"
+	}
+	return fmt.Sprintf(format, conflict.Method, conflict.Shadowed, conflict.By)
+}
+
+func Endpoints(router *mux.Router) ([]Endpoint, error) {
+	var endpoints []Endpoint
+
+	err := router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		pipeline, ok := route.GetHandler().(Pipeline)
+		if !ok {
+			return nil
+		}
+
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+
+		// Routes without host, method or query matchers return errors
+		host, _ := route.GetHostTemplate()
+		methods, _ := route.GetMethods()
+		queries, _ := route.GetQueriesTemplates()
+
+		endpoints = append(endpoints, Endpoint{
+			Host:     host,
+			Path:     path,
+			Methods:  methods,
+			Queries:  queries,
+			Pipeline: pipeline,
+			route:    route,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return endpoints, nil
+}
+
+// DetectConflicts reports endpoints that are ambiguous or shadowed by an
+// endpoint attached earlier. Two endpoints are duplicates when their paths
+// only differ in variable names and both match the same requests. An
+// endpoint is shadowed when a sample request built from its host, path,
+// query, schemes and headers is matched by an earlier endpoint.
+func DetectConflicts(router *mux.Router) ([]Conflict, error) {
+	endpoints, err := Endpoints(router)
+	if err != nil {
+		return nil, err
+	}
+
+	var conflicts []Conflict
+	for j, later := range endpoints {
+		sample, err := sampleRequest(later)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, method := range endpointMethods(later) {
+			for _, earlier := range endpoints[:j] {
+				if !containsMethod(endpointMethods(earlier), method) {
+					continue
+				}
+
+				if !matchesSample(earlier, method, sample) {
+					continue
+				}
+
+				kind := ShadowedConflict
+				if normalizePathTemplate(earlier.String()) == normalizePathTemplate(later.String()) {
+					kind = DuplicateConflict
+				}
+
+				conflicts = append(conflicts, Conflict{
+					Kind:     kind,
+					Method:   method,
+					Path:     later.Path,
+					Shadowed: later,
+					By:       earlier,
+				})
+				break
+			}
+		}
+	}
+
+	return conflicts, nil
+}
+
+// SamplePath builds a path that matches the path template by replacing each
+// variable with a short string matching its pattern.
+func SamplePath(template string) (string, error) {
+	var err error
+	sample := routeVariableRegexp.ReplaceAllStringFunc(template, func(variable string) string {
+		pattern := routeVariableRegexp.FindStringSubmatch(variable)[2]
+		if pattern == "" {
+			pattern = "[^/]+"
+		}
+
+		re, perr := syntax.Parse(pattern, syntax.Perl)
+		if perr != nil {
+			err = perr
+			return ""
+		}
+
+		return sampleRegexp(re.Simplify())
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return sample, nil
+}
+
+func sampleRegexp(re *syntax.Regexp) string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		return string(re.Rune)
+	case syntax.OpCharClass:
+		return string(sampleRune(re.Rune))
+	case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		return "a"
+	case syntax.OpCapture:
+		return sampleRegexp(re.Sub[0])
+	case syntax.OpPlus:
+		return sampleRegexp(re.Sub[0])
+	case syntax.OpRepeat:
+		return strings.Repeat(sampleRegexp(re.Sub[0]), re.Min)
+	case syntax.OpConcat:
+		var b strings.Builder
+		for _, sub := range re.Sub {
+			b.WriteString(sampleRegexp(sub))
+		}
+		return b.String()
+	case syntax.OpAlternate:
+		return sampleRegexp(re.Sub[0])
+	default:
+		return ""
+	}
+}
+
+// sampleRune prefers a readable rune from the ranges of a character class
+func sampleRune(ranges []rune) rune {
+	for _, r := range "a0A-_." {
+		for i := 0; i+1 < len(ranges); i += 2 {
+			if ranges[i] <= r && r <= ranges[i+1] {
+				return r
+			}
+		}
+	}
+	if len(ranges) == 0 {
+		return 'a'
+	}
+	return ranges[0]
+}
+
+func sampleRequest(endpoint Endpoint) (*http.Request, error) {
+	host, err := SamplePath(endpoint.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := SamplePath(endpoint.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	query := make([]string, len(endpoint.Queries))
+	for i, q := range endpoint.Queries {
+		query[i], err = SamplePath(q)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequest(DefaultRouteMethod, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Host = host
+	req.URL.RawQuery = strings.Join(query, "&")
+
+	// Schemes and headers are matched by the subrouters of the pipeline's
+	// routes, mux does not report them for the endpoint
+	for _, route := range endpoint.Pipeline {
+		var matchers Matchers
+		switch r := route.(type) {
+		case *BasicRoute:
+			matchers = r.Matchers
+		case *ResourceRoute:
+			matchers = r.Matchers
+		}
+
+		if len(matchers.Schemes) > 0 {
+			req.URL.Scheme = matchers.Schemes[0]
+		}
+		for name, value := range matchers.Headers {
+			if value == "" {
+				value = "x"
+			}
+			req.Header.Set(name, value)
+		}
+	}
+
+	return req, nil
+}
+
+func matchesSample(endpoint Endpoint, method string, sample *http.Request) bool {
+	req := sample.WithContext(sample.Context())
+	if method != "*" {
+		req.Method = method
+	}
+
+	var match mux.RouteMatch
+	return endpoint.route.Match(req, &match) && match.MatchErr == nil
+}
+
+func normalizePathTemplate(template string) string {
+	return routeVariableRegexp.ReplaceAllStringFunc(template, func(variable string) string {
+		pattern := routeVariableRegexp.FindStringSubmatch(variable)[2]
+		if pattern == "" {
+			pattern = "[^/]+"
+		}
+		return fmt.Sprintf("{%s}", pattern)
+	})
+}
+
+func endpointMethods(endpoint Endpoint) []string {
+	if len(endpoint.Methods) == 0 {
+		return []string{"*"}
+	}
+	return endpoint.Methods
+}
+
+func containsMethod(methods []string, method string) bool {
+	for _, m := range methods {
+		if m == "*" || method == "*" || m == method {
+			return true
+		}
+	}
+	return false
+}
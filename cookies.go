@@ -0,0 +1,113 @@
+package switchboard
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CookiesToEnv exports each request cookie as HTTP_COOKIE_<NAME>. When
+// several cookies map to the same name the first one sent is used, clients
+// send cookies with more specific paths first.
+func CookiesToEnv(r *http.Request) []string {
+	var env []string
+	seen := make(map[string]bool)
+	for _, cookie := range r.Cookies() {
+		key := fmt.Sprintf("HTTP_COOKIE_%s", EnvName(cookie.Name))
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		env = append(env, fmt.Sprintf("%s=%s", key, cookie.Value))
+	}
+	return env
+}
+
+// ParseSetCookie parses the value of an HTTP_SET_COOKIE tag, e.g.
+//
+//   session=abc123; Path=/; Max-Age=3600; Secure; HttpOnly; SameSite=Lax
+//
+// The supported attributes are Path, Domain, Max-Age, Expires, Secure,
+// HttpOnly and SameSite (Strict, Lax or None). Attribute names are case
+// insensitive. Unknown attributes and invalid values are rejected rather
+// than dropped.
+func ParseSetCookie(value string) (*http.Cookie, error) {
+	parts := strings.Split(value, ";")
+
+	pair := strings.SplitN(strings.TrimSpace(parts[0]), "=", 2)
+	if len(pair) != 2 || pair[0] == "" {
+		return nil, fmt.Errorf("invalid HTTP_SET_COOKIE value %s: expected name=value", value)
+	}
+	cookie := &http.Cookie{Name: pair[0], Value: pair[1]}
+
+	for _, part := range parts[1:] {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		attr := strings.SplitN(part, "=", 2)
+		name := strings.ToLower(attr[0])
+		val := ""
+		if len(attr) == 2 {
+			val = attr[1]
+		}
+
+		var err error
+		switch name {
+		case "path":
+			cookie.Path = val
+		case "domain":
+			cookie.Domain = val
+		case "max-age":
+			var maxAge int
+			maxAge, err = strconv.Atoi(val)
+			if maxAge <= 0 {
+				// A zero MaxAge leaves the attribute out, negative values
+				// expire the cookie immediately
+				maxAge = -1
+			}
+			cookie.MaxAge = maxAge
+		case "expires":
+			cookie.Expires, err = http.ParseTime(val)
+		case "secure":
+			cookie.Secure, err = true, flagAttribute(attr)
+		case "httponly":
+			cookie.HttpOnly, err = true, flagAttribute(attr)
+		case "samesite":
+			switch strings.ToLower(val) {
+			case "strict":
+				cookie.SameSite = http.SameSiteStrictMode
+			case "lax":
+				cookie.SameSite = http.SameSiteLaxMode
+			case "none":
+				cookie.SameSite = http.SameSiteNoneMode
+			default:
+				err = fmt.Errorf("must be Strict, Lax or None")
+			}
+		default:
+			err = fmt.Errorf("unsupported attribute")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid HTTP_SET_COOKIE attribute %s for cookie %s: %s", attr[0], cookie.Name, err)
+		}
+	}
+
+	if err := cookie.Valid(); err != nil {
+		return nil, fmt.Errorf("invalid HTTP_SET_COOKIE value for cookie %s: %s", cookie.Name, err)
+	}
+
+	if cookie.SameSite == http.SameSiteNoneMode && !cookie.Secure {
+		return nil, fmt.Errorf("invalid HTTP_SET_COOKIE value for cookie %s: SameSite=None requires Secure", cookie.Name)
+	}
+
+	return cookie, nil
+}
+
+func flagAttribute(attr []string) error {
+	if len(attr) == 2 {
+		return fmt.Errorf("does not take a value")
+	}
+	return nil
+}
@@ -9,6 +9,7 @@ import (
 	"os"
 	"os/exec"
 	"syscall"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
@@ -36,6 +37,8 @@ func LookupDriver(name string) (Driver, error) {
 		return LocalDriver{}, nil
 	case "docker":
 		return DockerDriver{}, nil
+	case "lua":
+		return DefaultLuaDriver, nil
 	default:
 		return nil, fmt.Errorf("driver \"%s\" not found", name)
 	}
@@ -65,13 +68,31 @@ func (driver LocalDriver) Execute(command *Command, env []string, streams *Strea
 		path = tmpfile.Name()
 	}
 
-	cmd := exec.Command("/bin/bash", "-c", path)
+	ctx := context.Background()
+	if command.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, command.Timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, "/bin/bash", "-c", path)
 	cmd.Env = append(os.Environ(), env...)
 	cmd.Stdin = streams.Stdin
 	cmd.Stdout = streams.Stdout
 	cmd.Stderr = streams.Stderr
 
+	// Kill the whole process group on timeout since inline commands run in
+	// a child of the shell
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = time.Second
+
 	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return -1, fmt.Errorf("command \"%s\" exceeded timeout of %s", command.Name, command.Timeout)
+	}
 	if err != nil {
 		exiterr, ok := err.(*exec.ExitError)
 		if !ok {
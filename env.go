@@ -0,0 +1,169 @@
+package switchboard
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	notEnvNameRegexp = regexp.MustCompile("[^A-Z0-9_]")
+	envKeyRegexp     = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+	// ProtectedEnvPrefixes are set from the request, tags and errors and
+	// cannot be changed with env tags
+	ProtectedEnvPrefixes = []string{"HTTP_", "TAG_", "ERROR_"}
+)
+
+// EnvName converts a header, cookie, param, query or form field name to the
+// form used in environment variable names. Letters are uppercased and every
+// other character that is not a digit or underscore becomes an underscore, e.g.
+// "Content-Type" becomes "CONTENT_TYPE". This is the reverse of HeaderName.
+func EnvName(name string) string {
+	return notEnvNameRegexp.ReplaceAllString(strings.ToUpper(name), "_")
+}
+
+// ValuesToEnv exports query parameters or form fields. Each name is
+// converted with EnvName and exported as:
+//
+//   <PREFIX><NAME>
+//   Every value joined with commas
+//
+//   <PREFIX><NAME>_<N>
+//   Each value, starting from 0
+//
+//   <PREFIX><NAME>_COUNT
+//   The number of values
+//
+// Names that convert to the same variable, e.g. "user-id" and "user_id",
+// are merged with the values of the names in sorted order. The plain
+// variable of a name always wins over the indexed and count variables of
+// another, so ?a=1&a_0=2 sets A_0 to 2. Names that convert to an empty
+// string are skipped.
+func ValuesToEnv(prefix string, values url.Values) []string {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	merged := make(map[string][]string)
+	for _, name := range names {
+		if key := EnvName(name); key != "" {
+			merged[key] = append(merged[key], values[name]...)
+		}
+	}
+
+	vars := make(map[string]string)
+	for key, vs := range merged {
+		vars[key+"_COUNT"] = strconv.Itoa(len(vs))
+		for i, v := range vs {
+			vars[fmt.Sprintf("%s_%d", key, i)] = v
+		}
+	}
+	for key, vs := range merged {
+		vars[key] = strings.Join(vs, ",")
+	}
+
+	keys := make([]string, 0, len(vars))
+	for key := range vars {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	env := make([]string, len(keys))
+	for i, key := range keys {
+		env[i] = fmt.Sprintf("%s%s=%s", prefix, key, vars[key])
+	}
+	return env
+}
+
+// ApplyEnvTags applies the env tags of a command to the environment passed
+// to the following commands. Variables are unset first, then set, then
+// appended to, and every value of each tag is applied in order:
+//
+//   ENV_UNSET: NAME
+//   Removes the variable
+//
+//   ENV_SET: NAME=value
+//   Sets the variable, the value may contain "="
+//
+//   ENV_APPEND: NAME=value
+//   Appends the value to the variable without a separator, or sets it if
+//   it is not set
+//
+// Variables starting with one of ProtectedEnvPrefixes are refused.
+func ApplyEnvTags(tags Tags, env []string) ([]string, error) {
+	for _, key := range tags["ENV_UNSET"] {
+		key = strings.TrimSpace(key)
+		if err := checkEnvKey("ENV_UNSET", key); err != nil {
+			return nil, err
+		}
+		env = UnsetEnv(env, key)
+	}
+
+	for _, tag := range []string{"ENV_SET", "ENV_APPEND"} {
+		for _, value := range tags[tag] {
+			pair := strings.SplitN(value, "=", 2)
+			if len(pair) != 2 {
+				return nil, fmt.Errorf("unrecognized %s value %s", tag, value)
+			}
+
+			key := pair[0]
+			if err := checkEnvKey(tag, key); err != nil {
+				return nil, err
+			}
+
+			if tag == "ENV_APPEND" {
+				current, _ := LookupEnv(env, key)
+				pair[1] = current + pair[1]
+			}
+			env = SetEnv(env, key, pair[1])
+		}
+	}
+
+	return env, nil
+}
+
+func checkEnvKey(tag string, key string) error {
+	if !envKeyRegexp.MatchString(key) {
+		return fmt.Errorf("unrecognized %s name %s", tag, key)
+	}
+
+	for _, prefix := range ProtectedEnvPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return fmt.Errorf("%s refused for protected variable %s", tag, key)
+		}
+	}
+	return nil
+}
+
+// LookupEnv returns the value of the last entry for key
+func LookupEnv(env []string, key string) (string, bool) {
+	for i := len(env) - 1; i >= 0; i-- {
+		if strings.HasPrefix(env[i], key+"=") {
+			return strings.TrimPrefix(env[i], key+"="), true
+		}
+	}
+	return "", false
+}
+
+// SetEnv returns a copy of env with every entry for key replaced by a
+// single entry with value
+func SetEnv(env []string, key string, value string) []string {
+	return append(UnsetEnv(env, key), fmt.Sprintf("%s=%s", key, value))
+}
+
+// UnsetEnv returns a copy of env without any entries for key
+func UnsetEnv(env []string, key string) []string {
+	unset := make([]string, 0, len(env))
+	for _, pair := range env {
+		if !strings.HasPrefix(pair, key+"=") {
+			unset = append(unset, pair)
+		}
+	}
+	return unset
+}
@@ -0,0 +1,210 @@
+package switchboard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+type contextKey int
+
+const (
+	errorHandlersKey contextKey = iota
+	routerKey
+	forwardKey
+	requestIDKey
+	cacheKey
+	compressionKey
+)
+
+// ErrorHandlers are commands that build the response when no route matches,
+// when the method is not allowed, or when a pipeline fails. They receive the
+// request environment along with:
+//
+//   ERROR_STATUS
+//   The status code of the error response
+//
+//   ERROR_MESSAGE
+//   A description of the error
+//
+//   ERROR_ROUTE
+//   The route that failed, if any
+//
+//   ERROR_EXIT_CODE
+//   The exit status of the failed command, if any
+//
+// The output of the failed command is available on STDIN. Output uses the
+// normal tag format and the status defaults to ERROR_STATUS.
+type ErrorHandlers struct {
+	NotFound         *Command
+	MethodNotAllowed *Command
+	Error            *Command
+}
+
+// CommandError is returned when a command could not be executed or completed
+// with a nonzero exit status
+type CommandError struct {
+	Command  string
+	Route    string
+	ExitCode int64
+	Err      error
+}
+
+func (err *CommandError) Error() string {
+	if err.Err != nil {
+		return err.Err.Error()
+	}
+	return fmt.Sprintf("command %s exited with status %d", err.Command, err.ExitCode)
+}
+
+func (err *CommandError) Unwrap() error {
+	return err.Err
+}
+
+// ErrorStatus returns the status for a failed pipeline, 502 for commands
+// with malformed output and 500 otherwise
+func ErrorStatus(err error) int {
+	var oerr *OutputError
+	if errors.As(err, &oerr) {
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+// HandlerError describes a failed request passed to the error handlers.
+// ContentType is used when responding with Body without an error handler.
+type HandlerError struct {
+	Status      int
+	Message     string
+	Route       string
+	ExitCode    int64
+	Body        string
+	ContentType string
+}
+
+func NewHandlerError(r *http.Request, status int, err error, body string) *HandlerError {
+	herr := &HandlerError{
+		Status:   status,
+		Message:  err.Error(),
+		ExitCode: -1,
+		Body:     body,
+	}
+
+	if cerr, ok := err.(*CommandError); ok {
+		herr.Route = cerr.Route
+		herr.ExitCode = cerr.ExitCode
+	} else if route := mux.CurrentRoute(r); route != nil {
+		herr.Route, _ = route.GetPathTemplate()
+	}
+
+	return herr
+}
+
+func (herr *HandlerError) Env() []string {
+	env := []string{
+		fmt.Sprintf("ERROR_STATUS=%d", herr.Status),
+		fmt.Sprintf("ERROR_MESSAGE=%s", herr.Message),
+		fmt.Sprintf("ERROR_ROUTE=%s", herr.Route),
+	}
+	if herr.ExitCode >= 0 {
+		env = append(env, fmt.Sprintf("ERROR_EXIT_CODE=%d", herr.ExitCode))
+	}
+	return env
+}
+
+func (handlers ErrorHandlers) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), errorHandlersKey, handlers)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func (handlers ErrorHandlers) NotFoundHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("no route found for %s %s", r.Method, r.URL.Path)
+		herr := &HandlerError{
+			Status:   http.StatusNotFound,
+			Message:  http.StatusText(http.StatusNotFound),
+			ExitCode: -1,
+		}
+		handlers.Handle(w, r, RequestToEnv(r), herr)
+	})
+}
+
+// MethodNotAllowedHandler responds with 405 and an Allow header listing the
+// methods routed for the request's path
+func (handlers ErrorHandlers) MethodNotAllowedHandler(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("method %s not allowed for %s", r.Method, r.URL.Path)
+		allowed := AllowedMethods(router, r)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		herr := &HandlerError{
+			Status:   http.StatusMethodNotAllowed,
+			Message:  http.StatusText(http.StatusMethodNotAllowed),
+			ExitCode: -1,
+		}
+		handlers.Handle(w, r, RequestToEnv(r), herr)
+	})
+}
+
+// HandleError responds using the error handlers attached to the request's
+// context, or a plain text response if there are none
+func HandleError(w http.ResponseWriter, r *http.Request, env []string, herr *HandlerError) {
+	handlers, _ := r.Context().Value(errorHandlersKey).(ErrorHandlers)
+	handlers.Handle(w, r, env, herr)
+}
+
+func (handlers ErrorHandlers) Handle(w http.ResponseWriter, r *http.Request, env []string, herr *HandlerError) {
+	var command *Command
+	switch herr.Status {
+	case http.StatusNotFound:
+		command = handlers.NotFound
+	case http.StatusMethodNotAllowed:
+		command = handlers.MethodNotAllowed
+	default:
+		command = handlers.Error
+	}
+
+	if command == nil {
+		if herr.ContentType != "" && herr.Body != "" {
+			w.Header().Set("Content-Type", herr.ContentType)
+			w.WriteHeader(herr.Status)
+			io.WriteString(w, herr.Body)
+			return
+		}
+
+		body := herr.Body
+		if body == "" {
+			body = herr.Message
+		}
+		http.Error(w, body, herr.Status)
+		return
+	}
+
+	env = append(append([]string{}, env...), herr.Env()...)
+	tags, body, err := HandleCommand(command, r, herr.Route, env, strings.NewReader(herr.Body))
+	if err != nil {
+		log.Printf("error handler failed: %s", err)
+		http.Error(w, herr.Message, herr.Status)
+		return
+	}
+
+	if _, ok := tags["HTTP_STATUS_CODE"]; !ok {
+		if _, ok := tags["HTTP_REDIRECT"]; !ok {
+			tags["HTTP_STATUS_CODE"] = []string{fmt.Sprintf("%d", herr.Status)}
+		}
+	}
+
+	err = ApplyEndTags(tags, w, r, strings.NewReader(body))
+	if err != nil {
+		log.Print("failed to apply tags")
+		http.Error(w, herr.Message, herr.Status)
+		return
+	}
+}
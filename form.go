@@ -0,0 +1,254 @@
+package switchboard
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	DefaultFormMaxSize  = 10 * 1024 * 1024
+	DefaultFormMaxFiles = 10
+)
+
+var (
+	errFormTooLarge = errors.New("request body too large")
+)
+
+// FormRules enable form parsing for a route. Multipart bodies, when
+// Multipart is set, are parsed into environment variables instead of being
+// sent to STDIN:
+//
+//   HTTP_FORM_<FIELD>
+//   The values of a text field, see ValuesToEnv for the indexed and count
+//   variables and how field names are converted
+//
+//   HTTP_FILE_<FIELD>_PATH, HTTP_FILE_<FIELD>_NAME, HTTP_FILE_<FIELD>_TYPE,
+//   HTTP_FILE_<FIELD>_SIZE
+//   The temp file an upload was written to, the file name sent by the
+//   client, its Content-Type and its size in bytes. When a field has several
+//   files the first is used, and every file is also available as
+//   HTTP_FILE_<FIELD>_<N>_PATH etc. with HTTP_FILE_<FIELD>_COUNT files.
+//
+// When URLEncoded is set, application/x-www-form-urlencoded bodies are
+// exported as HTTP_FORM_<FIELD> variables and still sent to STDIN.
+//
+// Uploads are removed once the response is written. Bodies larger than
+// MaxSize, or with more than MaxFiles files, respond with 413 Request
+// Entity Too Large.
+type FormRules struct {
+	Multipart  bool
+	URLEncoded bool
+	MaxSize    int64
+	MaxFiles   int
+}
+
+// Form is a parsed request body, Body is sent to STDIN
+type Form struct {
+	Env  []string
+	Dir  string
+	Body []byte
+}
+
+// Remove deletes the uploaded files
+func (form *Form) Remove() {
+	if form != nil && form.Dir != "" {
+		os.RemoveAll(form.Dir)
+	}
+}
+
+// FormRules returns the form rules of the innermost route in the pipeline
+func (pipeline Pipeline) FormRules() *FormRules {
+	for i := len(pipeline) - 1; i >= 0; i-- {
+		switch r := pipeline[i].(type) {
+		case *BasicRoute:
+			if r.Form != nil {
+				return r.Form
+			}
+		case *ResourceRoute:
+			if r.Form != nil {
+				return r.Form
+			}
+		}
+	}
+	return nil
+}
+
+// ParseForm parses a multipart or urlencoded body read from stdin. It
+// returns nil when the rules do not apply to the request.
+func ParseForm(r *http.Request, rules *FormRules, stdin io.Reader) (*Form, *ValidationError) {
+	if rules == nil || stdin == nil {
+		return nil, nil
+	}
+
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, nil
+	}
+
+	form := &Form{}
+	reader := &limitedReader{stdin, rules.MaxSize}
+	switch {
+	case mediaType == "multipart/form-data" && rules.Multipart:
+		if params["boundary"] == "" {
+			return nil, &ValidationError{Status: http.StatusBadRequest, Message: "multipart body is missing a boundary"}
+		}
+		err = form.parseMultipart(multipart.NewReader(reader, params["boundary"]), rules)
+	case mediaType == "application/x-www-form-urlencoded" && rules.URLEncoded:
+		err = form.parseURLEncoded(reader)
+	default:
+		return nil, nil
+	}
+
+	if err != nil {
+		form.Remove()
+		if errors.Is(err, errFormTooLarge) {
+			return nil, &ValidationError{Status: http.StatusRequestEntityTooLarge, Message: err.Error()}
+		}
+		return nil, &ValidationError{Status: http.StatusBadRequest, Message: fmt.Sprintf("malformed form body: %s", err)}
+	}
+	return form, nil
+}
+
+func (form *Form) parseURLEncoded(reader io.Reader) error {
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return err
+	}
+
+	form.Env = ValuesToEnv("HTTP_FORM_", values)
+	form.Body = body
+	log.Printf("parsed urlencoded body with %d fields", len(values))
+	return nil
+}
+
+func (form *Form) parseMultipart(reader *multipart.Reader, rules *FormRules) error {
+	fields := make(url.Values)
+	files := make(map[string]int)
+	var fileOrder []string
+	count := 0
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if part.FileName() == "" {
+			b, err := ioutil.ReadAll(part)
+			part.Close()
+			if err != nil {
+				return err
+			}
+			fields.Add(part.FormName(), string(b))
+			continue
+		}
+
+		name := EnvName(part.FormName())
+		if name == "" {
+			part.Close()
+			continue
+		}
+
+		count++
+		if count > rules.MaxFiles {
+			part.Close()
+			return errFormTooLarge
+		}
+
+		if form.Dir == "" {
+			form.Dir, err = ioutil.TempDir("", "switchboard-upload-")
+			if err != nil {
+				part.Close()
+				return err
+			}
+		}
+
+		path := filepath.Join(form.Dir, strconv.Itoa(count))
+		size, err := writeUpload(path, part)
+		part.Close()
+		if err != nil {
+			return err
+		}
+
+		i := files[name]
+		if i == 0 {
+			fileOrder = append(fileOrder, name)
+		}
+		files[name] = i + 1
+
+		contentType := part.Header.Get("Content-Type")
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+
+		vars := []struct{ suffix, value string }{
+			{"PATH", path},
+			{"NAME", filepath.Base(part.FileName())},
+			{"TYPE", contentType},
+			{"SIZE", strconv.FormatInt(size, 10)},
+		}
+		for _, v := range vars {
+			if i == 0 {
+				form.Env = append(form.Env, fmt.Sprintf("HTTP_FILE_%s_%s=%s", name, v.suffix, v.value))
+			}
+			form.Env = append(form.Env, fmt.Sprintf("HTTP_FILE_%s_%d_%s=%s", name, i, v.suffix, v.value))
+		}
+	}
+
+	for _, name := range fileOrder {
+		form.Env = append(form.Env, fmt.Sprintf("HTTP_FILE_%s_COUNT=%d", name, files[name]))
+	}
+	form.Env = append(form.Env, ValuesToEnv("HTTP_FORM_", fields)...)
+
+	log.Printf("parsed multipart body with %d fields and %d files", len(fields), count)
+	return nil
+}
+
+func writeUpload(path string, part io.Reader) (int64, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	return io.Copy(file, part)
+}
+
+// limitedReader fails with errFormTooLarge instead of returning EOF once
+// more than n bytes are read
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, errFormTooLarge
+	}
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, errFormTooLarge
+	}
+	return n, err
+}
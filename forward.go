@@ -0,0 +1,91 @@
+package switchboard
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	MaxForwardHops = 10
+)
+
+// Forward dispatches the request to the route matching target without
+// responding to the client. The target's pipeline runs with the current
+// environment, tags and body, and its path variables are added to the
+// environment. Forwarding to a path that was already visited, or more than
+// MaxForwardHops times, fails with 508 Loop Detected.
+func Forward(w http.ResponseWriter, r *http.Request, env []string, tags Tags, stdin io.Reader, target string) {
+	router, ok := r.Context().Value(routerKey).(*mux.Router)
+	if !ok {
+		err := fmt.Errorf("cannot forward to %s without a router", target)
+		HandleError(w, r, env, NewHandlerError(r, http.StatusInternalServerError, err, ""))
+		return
+	}
+
+	u, err := r.URL.Parse(target)
+	if err != nil {
+		err = fmt.Errorf("invalid FORWARD value %s: %s", target, err)
+		HandleError(w, r, env, NewHandlerError(r, http.StatusInternalServerError, err, ""))
+		return
+	}
+
+	visited, _ := r.Context().Value(forwardKey).([]string)
+	if len(visited) == 0 {
+		visited = []string{r.URL.Path}
+	}
+
+	for _, path := range visited {
+		if path == u.Path {
+			err := fmt.Errorf("forward loop detected: %s -> %s", strings.Join(visited, " -> "), u.Path)
+			HandleError(w, r, env, NewHandlerError(r, http.StatusLoopDetected, err, ""))
+			return
+		}
+	}
+
+	if len(visited) > MaxForwardHops {
+		err := fmt.Errorf("exceeded %d forwards: %s", MaxForwardHops, strings.Join(visited, " -> "))
+		HandleError(w, r, env, NewHandlerError(r, http.StatusLoopDetected, err, ""))
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), forwardKey, append(visited[:len(visited):len(visited)], u.Path))
+	req := r.Clone(ctx)
+	req.URL = u
+	req.RequestURI = u.RequestURI()
+
+	var match mux.RouteMatch
+	if !router.Match(req, &match) || match.MatchErr != nil {
+		err := fmt.Errorf("no route found to forward %s %s", req.Method, u.Path)
+		HandleError(w, r, env, NewHandlerError(r, http.StatusInternalServerError, err, ""))
+		return
+	}
+
+	pipeline, ok := match.Route.GetHandler().(Pipeline)
+	if !ok {
+		err := fmt.Errorf("route for %s cannot be forwarded to", u.Path)
+		HandleError(w, r, env, NewHandlerError(r, http.StatusInternalServerError, err, ""))
+		return
+	}
+
+	log.Printf("forwarding %s to %s", r.URL.Path, u.Path)
+	req = mux.SetURLVars(req, match.Vars)
+	env = append(append([]string{}, env...), fmt.Sprintf("HTTP_FORWARDED_FROM=%s", r.URL.Path))
+	env = append(env, VarsToEnv(match.Vars)...)
+
+	pipeline.Run(w, req, env, tags, stdin)
+}
+
+func RouterMiddleware(router *mux.Router) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), routerKey, router)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package switchboard
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	RawInput     = "raw"
+	JSONInput    = "json"
+	DefaultInput = RawInput
+)
+
+// InputEnvelope is the STDIN of commands with "input: json". The request
+// environment variables are still set. Headers and query parameters keep
+// every value. When several cookies share a name the first one sent is
+// used. The body is the output of the previous command, or the request
+// body for the first command, and is sent as text when it is valid UTF-8
+// and as body_base64 otherwise.
+type InputEnvelope struct {
+	Method     string              `json:"method"`
+	URL        string              `json:"url"`
+	Scheme     string              `json:"scheme"`
+	Host       string              `json:"host"`
+	Port       string              `json:"port"`
+	Path       string              `json:"path"`
+	RawQuery   string              `json:"raw_query"`
+	Headers    map[string][]string `json:"headers"`
+	Query      map[string][]string `json:"query"`
+	Params     map[string]string   `json:"params"`
+	Cookies    map[string]string   `json:"cookies"`
+	RemoteAddr string              `json:"remote_addr"`
+	Body       *string             `json:"body"`
+	BodyBase64 *string             `json:"body_base64,omitempty"`
+}
+
+func NewInputEnvelope(r *http.Request, body []byte) *InputEnvelope {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	u := *r.URL
+	u.Scheme = scheme
+	u.Host = r.Host
+
+	envelope := &InputEnvelope{
+		Method:     r.Method,
+		URL:        u.String(),
+		Scheme:     scheme,
+		Host:       u.Hostname(),
+		Port:       u.Port(),
+		Path:       u.Path,
+		RawQuery:   u.RawQuery,
+		Headers:    r.Header,
+		Query:      u.Query(),
+		Params:     mux.Vars(r),
+		Cookies:    make(map[string]string),
+		RemoteAddr: r.RemoteAddr,
+	}
+
+	if envelope.Headers == nil {
+		envelope.Headers = make(map[string][]string)
+	}
+	if envelope.Params == nil {
+		envelope.Params = make(map[string]string)
+	}
+
+	for _, cookie := range r.Cookies() {
+		if _, ok := envelope.Cookies[cookie.Name]; !ok {
+			envelope.Cookies[cookie.Name] = cookie.Value
+		}
+	}
+
+	if utf8.Valid(body) {
+		s := string(body)
+		envelope.Body = &s
+	} else {
+		s := base64.StdEncoding.EncodeToString(body)
+		envelope.BodyBase64 = &s
+	}
+
+	return envelope
+}
+
+// CommandInput returns the STDIN for the command, wrapping the body in an
+// InputEnvelope for commands with "input: json"
+func CommandInput(command *Command, r *http.Request, stdin io.Reader) (io.Reader, error) {
+	if command.Input != JSONInput || r == nil {
+		return stdin, nil
+	}
+
+	body, err := ioutil.ReadAll(stdin)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(NewInputEnvelope(r, body))
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(b), nil
+}
@@ -0,0 +1,168 @@
+package switchboard
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	RequestIDHeader = "X-Request-Id"
+)
+
+var (
+	requestIDRegexp = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+)
+
+// RequestIDMiddleware assigns each request an id, reusing the X-Request-Id
+// header when the client sends a reasonable one. The id is included in the
+// response headers, the HTTP_REQUEST_ID variable and structured logs.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !requestIDRegexp.MatchString(id) {
+			id = newRequestID()
+		}
+
+		w.Header().Set(RequestIDHeader, id)
+		ctx := context.WithValue(r.Context(), requestIDKey, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func RequestID(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
+
+// RequestLogger returns the structured logger for the request
+func RequestLogger(r *http.Request) *slog.Logger {
+	logger := slog.Default()
+	if id := RequestID(r); id != "" {
+		logger = logger.With("request_id", id)
+	}
+	return logger
+}
+
+// LogTags sends the logging tags of a command to the logger and removes
+// them from the tags:
+//
+//   LOG_INFO, LOG_WARN, LOG_ERROR
+//   Logs each value at the level
+//
+//   LOG_FIELDS
+//   Adds key=value pairs to the command's log messages, values containing
+//   spaces may be quoted, e.g. LOG_FIELDS: user_id=1 action="sign in"
+//
+//   DEBUG
+//   Logs each value at the info level with tag=DEBUG
+//
+// Malformed fields are logged as a warning instead of failing the request.
+func LogTags(logger *slog.Logger, tags Tags) {
+	var fields []any
+	for _, value := range tags["LOG_FIELDS"] {
+		parsed, err := ParseLogFields(value)
+		if err != nil {
+			logger.Warn("ignoring malformed LOG_FIELDS", "value", value, "error", err)
+			continue
+		}
+		fields = append(fields, parsed...)
+	}
+	logger = logger.With(fields...)
+
+	for _, value := range tags["DEBUG"] {
+		logger.Info(value, "tag", "DEBUG")
+	}
+
+	for _, level := range []struct {
+		tag   string
+		level slog.Level
+	}{
+		{"LOG_INFO", slog.LevelInfo},
+		{"LOG_WARN", slog.LevelWarn},
+		{"LOG_ERROR", slog.LevelError},
+	} {
+		for _, value := range tags[level.tag] {
+			logger.Log(context.Background(), level.level, value)
+		}
+	}
+
+	for _, tag := range []string{"DEBUG", "LOG_INFO", "LOG_WARN", "LOG_ERROR", "LOG_FIELDS"} {
+		delete(tags, tag)
+	}
+}
+
+// ParseLogFields parses space separated key=value pairs. Values may be
+// double quoted with Go string escapes.
+func ParseLogFields(value string) ([]any, error) {
+	var fields []any
+	rest := strings.TrimSpace(value)
+	for rest != "" {
+		eq := strings.IndexByte(rest, '=')
+		if eq <= 0 || strings.IndexFunc(rest[:eq], unicode.IsSpace) >= 0 {
+			return nil, fmt.Errorf("expected key=value at %q", rest)
+		}
+		key := rest[:eq]
+		rest = rest[eq+1:]
+
+		var v string
+		if strings.HasPrefix(rest, `"`) {
+			quoted, err := strconv.QuotedPrefix(rest)
+			if err != nil {
+				return nil, fmt.Errorf("unterminated quoted value for %s", key)
+			}
+			v, _ = strconv.Unquote(quoted)
+			rest = rest[len(quoted):]
+			if rest != "" && !unicode.IsSpace(rune(rest[0])) {
+				return nil, fmt.Errorf("expected a space after the value for %s", key)
+			}
+		} else {
+			end := strings.IndexFunc(rest, unicode.IsSpace)
+			if end < 0 {
+				end = len(rest)
+			}
+			v = rest[:end]
+			rest = rest[end:]
+		}
+
+		fields = append(fields, key, v)
+		rest = strings.TrimLeftFunc(rest, unicode.IsSpace)
+	}
+	return fields, nil
+}
+
+// LogStderr logs each line a command wrote to STDERR
+func LogStderr(logger *slog.Logger, stderr io.Reader) error {
+	reader := bufio.NewReader(stderr)
+	for {
+		line, err := reader.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if line != "" {
+			logger.Info(line, "stream", "stderr")
+		}
+
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package switchboard
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+const (
+	DefaultLuaTimeout     = 5 * time.Second
+	DefaultLuaMemoryLimit = 64 * 1024 * 1024
+	DefaultLuaPoolSize    = 16
+
+	luaRegistrySize    = 1024
+	luaRegistryMaxSize = 256 * 1024
+	luaCallStackSize   = 256
+)
+
+var (
+	DefaultLuaDriver = NewLuaDriver(DefaultLuaPoolSize)
+
+	// luaBaseFunctions are the base library functions available to scripts,
+	// functions that reach outside of the sandbox or modify the environment,
+	// such as _G, getfenv, setfenv, rawset and load, are left out
+	luaBaseFunctions = []string{
+		"_VERSION", "assert", "error", "ipairs", "next", "pairs", "pcall", "rawequal",
+		"select", "setmetatable", "tonumber", "tostring", "type", "unpack", "xpcall",
+	}
+
+	luaLibraries = []string{lua.TabLibName, lua.StringLibName, lua.MathLibName}
+
+	errLuaMemoryLimit = errors.New("memory limit exceeded")
+)
+
+// LuaDriver runs inline Lua scripts in-process instead of forking a shell.
+// Interpreter states are pooled and reused between executions, and compiled
+// scripts are cached by their source.
+//
+// Scripts run in a sandbox with the table, string and math libraries and the
+// base functions that cannot reach outside of it. Globals set by a script,
+// including changes to the libraries, are discarded after the execution.
+// The following globals are also available:
+//
+//   env
+//   A table of the request environment (HTTP_METHOD, HTTP_URL_PATH, ...)
+//
+//   stdin.read([format]), stdin.lines()
+//   Reads from STDIN, format is "a" (default), "l" or a number of bytes
+//
+//   print(...), write(...)
+//   Write to STDOUT, output uses the normal tag format
+//
+//   log(...)
+//   Writes a line to STDERR
+//
+// A script may return a number which is used as the exit status.
+//
+// Each execution is limited by the command timeout and the command memory
+// limit, a budget of bytes read from STDIN, written with print, write and
+// log, and created by string.rep. Exceeding either aborts the script.
+type LuaDriver struct {
+	mu     sync.Mutex
+	pool   chan *lua.LState
+	protos map[string]*lua.FunctionProto
+}
+
+func NewLuaDriver(size int) *LuaDriver {
+	return &LuaDriver{
+		pool:   make(chan *lua.LState, size),
+		protos: make(map[string]*lua.FunctionProto),
+	}
+}
+
+// luaBudget is the number of bytes an execution may still use. Once it is
+// spent the execution's context is canceled, which aborts the script even
+// if it catches the error.
+type luaBudget struct {
+	remaining int64
+	exceeded  bool
+	cancel    context.CancelFunc
+}
+
+func (budget *luaBudget) spend(n int64) error {
+	if n > budget.remaining {
+		budget.remaining = 0
+		budget.exceeded = true
+		budget.cancel()
+		return errLuaMemoryLimit
+	}
+	budget.remaining -= n
+	return nil
+}
+
+// luaBudgetReader charges the budget for every byte read
+type luaBudgetReader struct {
+	r      io.Reader
+	budget *luaBudget
+}
+
+func (br *luaBudgetReader) Read(p []byte) (int, error) {
+	n, err := br.r.Read(p)
+	if berr := br.budget.spend(int64(n)); berr != nil {
+		return 0, berr
+	}
+	return n, err
+}
+
+func (driver *LuaDriver) Execute(command *Command, env []string, streams *Streams) (int64, error) {
+	if command.Inline == "" {
+		return -1, fmt.Errorf("lua command \"%s\" has no inline script", command.Name)
+	}
+
+	proto, err := driver.Compile(command.Name, command.Inline)
+	if err != nil {
+		return -1, err
+	}
+
+	timeout := command.Timeout
+	if timeout == 0 {
+		timeout = DefaultLuaTimeout
+	}
+
+	limit := command.MemoryLimit
+	if limit == 0 {
+		limit = DefaultLuaMemoryLimit
+	}
+
+	L := driver.acquire()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	L.SetContext(ctx)
+
+	budget := &luaBudget{remaining: int64(limit), cancel: cancel}
+	fn := L.NewFunctionFromProto(proto)
+	L.SetFEnv(fn, luaSandbox(L, env, streams, budget))
+	L.Push(fn)
+	err = L.PCall(0, 1, nil)
+	L.RemoveContext()
+
+	if err != nil {
+		// A state that was interrupted may be left in an inconsistent state,
+		// so it is discarded instead of being returned to the pool.
+		L.Close()
+
+		if budget.exceeded {
+			return -1, fmt.Errorf("lua command \"%s\" exceeded memory limit of %d bytes", command.Name, limit)
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			return -1, fmt.Errorf("lua command \"%s\" exceeded timeout of %s", command.Name, timeout)
+		}
+
+		io.WriteString(streams.Stderr, err.Error()+"\n")
+		return 1, nil
+	}
+
+	status := int64(0)
+	if n, ok := L.Get(-1).(lua.LNumber); ok {
+		status = int64(n)
+	}
+	driver.release(L)
+
+	return status, nil
+}
+
+func (driver *LuaDriver) Compile(name string, script string) (*lua.FunctionProto, error) {
+	driver.mu.Lock()
+	proto, ok := driver.protos[script]
+	driver.mu.Unlock()
+	if ok {
+		return proto, nil
+	}
+
+	chunk, err := parse.Parse(strings.NewReader(script), name)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing lua command \"%s\": %s", name, err)
+	}
+
+	proto, err = lua.Compile(chunk, name)
+	if err != nil {
+		return nil, fmt.Errorf("error compiling lua command \"%s\": %s", name, err)
+	}
+
+	driver.mu.Lock()
+	driver.protos[script] = proto
+	driver.mu.Unlock()
+
+	return proto, nil
+}
+
+func (driver *LuaDriver) acquire() *lua.LState {
+	select {
+	case L := <-driver.pool:
+		return L
+	default:
+		return newLuaState()
+	}
+}
+
+func (driver *LuaDriver) release(L *lua.LState) {
+	L.SetTop(0)
+	select {
+	case driver.pool <- L:
+	default:
+		L.Close()
+	}
+}
+
+func newLuaState() *lua.LState {
+	L := lua.NewState(lua.Options{
+		SkipOpenLibs:    true,
+		RegistrySize:    luaRegistrySize,
+		RegistryMaxSize: luaRegistryMaxSize,
+		CallStackSize:   luaCallStackSize,
+	})
+
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+
+	return L
+}
+
+// luaSandbox builds the per execution globals table. It holds the allowed
+// base functions and copies of the library tables, so scripts cannot modify
+// state that outlives the execution.
+func luaSandbox(L *lua.LState, env []string, streams *Streams, budget *luaBudget) *lua.LTable {
+	globals := L.Get(lua.GlobalsIndex).(*lua.LTable)
+	sandbox := L.NewTable()
+	for _, name := range luaBaseFunctions {
+		sandbox.RawSetString(name, globals.RawGetString(name))
+	}
+	for _, name := range luaLibraries {
+		lib := L.NewTable()
+		if shared, ok := globals.RawGetString(name).(*lua.LTable); ok {
+			shared.ForEach(func(key lua.LValue, value lua.LValue) {
+				if key.String() != "__index" {
+					lib.RawSet(key, value)
+				}
+			})
+		}
+		sandbox.RawSetString(name, lib)
+	}
+
+	strlib := sandbox.RawGetString(lua.StringLibName).(*lua.LTable)
+	strlib.RawSetString("rep", L.NewFunction(func(L *lua.LState) int {
+		str := L.CheckString(1)
+		n := L.CheckInt(2)
+		if n <= 0 || str == "" {
+			L.Push(lua.LString(""))
+			return 1
+		}
+		if n > math.MaxInt64/len(str) {
+			n = math.MaxInt64 / len(str)
+		}
+		if err := budget.spend(int64(len(str)) * int64(n)); err != nil {
+			L.RaiseError("%s", err)
+		}
+		L.Push(lua.LString(strings.Repeat(str, n)))
+		return 1
+	}))
+
+	// The builtin getmetatable returns the shared string library for strings
+	sandbox.RawSetString("getmetatable", L.NewFunction(func(L *lua.LState) int {
+		if table, ok := L.CheckAny(1).(*lua.LTable); ok {
+			L.Push(L.GetMetatable(table))
+		} else {
+			L.Push(lua.LNil)
+		}
+		return 1
+	}))
+
+	envTable := L.NewTable()
+	for _, pair := range env {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		envTable.RawSetString(kv[0], lua.LString(kv[1]))
+	}
+	sandbox.RawSetString("env", envTable)
+
+	stdin := bufio.NewReader(&luaBudgetReader{streams.Stdin, budget})
+	stdinTable := L.NewTable()
+	stdinTable.RawSetString("read", L.NewFunction(func(L *lua.LState) int {
+		value, err := luaRead(stdin, L.Get(1))
+		if err != nil {
+			L.RaiseError("%s", err)
+		}
+		L.Push(value)
+		return 1
+	}))
+	stdinTable.RawSetString("lines", L.NewFunction(func(L *lua.LState) int {
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			value, err := luaRead(stdin, lua.LString("l"))
+			if err != nil {
+				L.RaiseError("%s", err)
+			}
+			L.Push(value)
+			return 1
+		}))
+		return 1
+	}))
+	sandbox.RawSetString("stdin", stdinTable)
+
+	sandbox.RawSetString("print", luaWriter(L, streams.Stdout, "\t", "\n", budget))
+	sandbox.RawSetString("write", luaWriter(L, streams.Stdout, "", "", budget))
+	sandbox.RawSetString("log", luaWriter(L, streams.Stderr, "\t", "\n", budget))
+
+	return sandbox
+}
+
+func luaWriter(L *lua.LState, w io.Writer, sep string, end string, budget *luaBudget) *lua.LFunction {
+	return L.NewFunction(func(L *lua.LState) int {
+		top := L.GetTop()
+		values := make([]string, top)
+		for i := 1; i <= top; i++ {
+			values[i-1] = L.ToStringMeta(L.Get(i)).String()
+		}
+
+		output := strings.Join(values, sep) + end
+		if err := budget.spend(int64(len(output))); err != nil {
+			L.RaiseError("%s", err)
+		}
+		io.WriteString(w, output)
+		return 0
+	})
+}
+
+func luaRead(r *bufio.Reader, format lua.LValue) (lua.LValue, error) {
+	switch f := format.(type) {
+	case lua.LNumber:
+		if f < 0 {
+			return nil, errors.New("invalid stdin.read size")
+		}
+
+		// The buffer grows as data arrives, the size may be far larger than
+		// the body
+		b, err := ioutil.ReadAll(io.LimitReader(r, int64(f)))
+		if err != nil {
+			return nil, err
+		}
+		if len(b) == 0 && f > 0 {
+			return lua.LNil, nil
+		}
+		return lua.LString(b), nil
+	case *lua.LNilType, lua.LString:
+		switch strings.TrimPrefix(lua.LVAsString(f), "*") {
+		case "", "a":
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				return nil, err
+			}
+			return lua.LString(b), nil
+		case "l":
+			line, err := r.ReadString('\n')
+			if line == "" && err != nil {
+				if err == io.EOF {
+					return lua.LNil, nil
+				}
+				return nil, err
+			}
+			return lua.LString(strings.TrimSuffix(line, "\n")), nil
+		}
+	}
+
+	return nil, errors.New("invalid stdin.read format")
+}
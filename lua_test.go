@@ -0,0 +1,143 @@
+package switchboard_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vanstee/switchboard"
+)
+
+var (
+	luaTests = []struct {
+		inline string
+		env    []string
+		stdin  string
+		stdout string
+		stderr string
+		status int64
+	}{
+		{
+			inline: `print("HTTP_STATUS_CODE: 201") print() write("hello " .. env.NAME)`,
+			env:    []string{"NAME=world"},
+			stdout: "HTTP_STATUS_CODE: 201\n\nhello world",
+		},
+		{
+			inline: `for line in stdin.lines() do print(line:upper()) end`,
+			stdin:  "a\nb\n",
+			stdout: "A\nB\n",
+		},
+		{
+			inline: `log("failed") return 3`,
+			stderr: "failed\n",
+			status: 3,
+		},
+		{
+			inline: `error("boom")`,
+			stderr: "test:1: boom",
+			status: 1,
+		},
+		{
+			inline: `leaked = env.NAME print(leaked)`,
+			env:    []string{"NAME=first"},
+			stdout: "first\n",
+		},
+		{
+			inline: `print(leaked)`,
+			stdout: "nil\n",
+		},
+		{
+			inline: `string.upper = function() return "pwned" end
+				table.concat = nil
+				pcall(function() getmetatable("").__index.upper = function() return "pwned" end end)
+				print(string.upper("a"))`,
+			stdout: "pwned\n",
+		},
+		{
+			inline: `print(string.upper("a"), ("b"):upper(), table.concat({"c"}))`,
+			stdout: "A\tB\tc\n",
+		},
+		{
+			inline: `print(#stdin.read(1e12), stdin.read(1))`,
+			stdin:  "abc",
+			stdout: "3\tnil\n",
+		},
+		{
+			inline: `stdin.read(-1)`,
+			stderr: "invalid stdin.read size",
+			status: 1,
+		},
+		{
+			inline: `print(_G, getfenv, setfenv, rawset, rawget, load, getmetatable(""))`,
+			stdout: "nil\tnil\tnil\tnil\tnil\tnil\tnil\n",
+		},
+	}
+)
+
+func TestLuaDriver(t *testing.T) {
+	driver := switchboard.NewLuaDriver(1)
+
+	for _, test := range luaTests {
+		var stdout, stderr bytes.Buffer
+		command := &switchboard.Command{Name: "test", Inline: test.inline}
+
+		status, err := driver.Execute(command, test.env, &switchboard.Streams{
+			Stdin:  strings.NewReader(test.stdin),
+			Stdout: &stdout,
+			Stderr: &stderr,
+		})
+		if err != nil {
+			t.Fatalf("Execute returned an error: %s", err)
+		}
+		if status != test.status {
+			t.Errorf("expected status %d, got %d", test.status, status)
+		}
+		if stdout.String() != test.stdout {
+			t.Errorf("expected stdout to be %#v, got %#v", test.stdout, stdout.String())
+		}
+		if !strings.Contains(stderr.String(), test.stderr) {
+			t.Errorf("expected stderr to contain %#v, got %#v", test.stderr, stderr.String())
+		}
+	}
+}
+
+func TestLuaDriverLimits(t *testing.T) {
+	driver := switchboard.NewLuaDriver(1)
+
+	command := &switchboard.Command{Name: "loop", Inline: `while true do end`, Timeout: 50 * time.Millisecond}
+	_, err := driver.Execute(command, nil, &switchboard.Streams{strings.NewReader(""), &bytes.Buffer{}, &bytes.Buffer{}})
+	if err == nil {
+		t.Errorf("expected a timeout error")
+	}
+
+	var stderr bytes.Buffer
+	command = &switchboard.Command{Name: "recurse", Inline: `local function f(n) return f(n + 1) + 1 end f(1)`}
+	status, err := driver.Execute(command, nil, &switchboard.Streams{strings.NewReader(""), &bytes.Buffer{}, &stderr})
+	if err != nil {
+		t.Fatalf("Execute returned an error: %s", err)
+	}
+	if status != 1 {
+		t.Errorf("expected status %d, got %d", 1, status)
+	}
+
+	for _, test := range []struct {
+		inline string
+		stdin  string
+	}{
+		{`print(#string.rep("a", 1e12))`, ""},
+		{`pcall(string.rep, "a", 4096) print("caught")`, ""},
+		{`for i = 1, 1000 do write("aaaa") end`, ""},
+		{`print(#stdin.read("a"))`, strings.Repeat("a", 4096)},
+	} {
+		var stdout bytes.Buffer
+		command = &switchboard.Command{Name: "memory", Inline: test.inline, MemoryLimit: 1024}
+		_, err = driver.Execute(command, nil, &switchboard.Streams{strings.NewReader(test.stdin), &stdout, &bytes.Buffer{}})
+		if err == nil || !strings.Contains(err.Error(), "exceeded memory limit") {
+			t.Errorf("%s expected a memory limit error, got %v", test.inline, err)
+		}
+		if strings.Contains(stdout.String(), "caught") {
+			t.Errorf("%s expected the script to be aborted", test.inline)
+		}
+	}
+}
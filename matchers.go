@@ -0,0 +1,70 @@
+package switchboard
+
+import (
+	"sort"
+
+	"github.com/gorilla/mux"
+)
+
+// Matchers restrict a route to requests with a matching host, scheme,
+// headers or query parameters in addition to the path and method. Host and
+// query values may contain variables, e.g. "{tenant}.example.com", which are
+// exported along with path variables as HTTP_PARAM_* environment variables.
+//
+// Matchers apply to the route and all of its child routes.
+type Matchers struct {
+	Host    string
+	Schemes []string
+	Headers map[string]string
+	Queries map[string]string
+}
+
+func (matchers Matchers) Empty() bool {
+	return matchers.Host == "" &&
+		len(matchers.Schemes) == 0 &&
+		len(matchers.Headers) == 0 &&
+		len(matchers.Queries) == 0
+}
+
+// Subrouter returns a router whose routes only match requests accepted by the
+// matchers. The router is returned unchanged if there are no matchers.
+func (matchers Matchers) Subrouter(router *mux.Router) *mux.Router {
+	if matchers.Empty() {
+		return router
+	}
+
+	route := router.NewRoute()
+
+	if matchers.Host != "" {
+		route.Host(matchers.Host)
+	}
+
+	if len(matchers.Schemes) > 0 {
+		route.Schemes(matchers.Schemes...)
+	}
+
+	if len(matchers.Headers) > 0 {
+		route.Headers(matcherPairs(matchers.Headers)...)
+	}
+
+	if len(matchers.Queries) > 0 {
+		route.Queries(matcherPairs(matchers.Queries)...)
+	}
+
+	return route.Subrouter()
+}
+
+// matcherPairs flattens the map into key value pairs ordered by key
+func matcherPairs(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(m)*2)
+	for _, key := range keys {
+		pairs = append(pairs, key, m[key])
+	}
+	return pairs
+}
@@ -0,0 +1,369 @@
+package switchboard
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	OpenAPIVersion = "3.0.3"
+
+	DefaultOpenAPIPath    = "/openapi.json"
+	DefaultOpenAPITitle   = "switchboard"
+	DefaultOpenAPIVersion = "1.0.0"
+)
+
+// RouteDocs documents a route in the generated OpenAPI document
+type RouteDocs struct {
+	Summary     string
+	Description string
+	RequestBody *BodyDocs
+	Responses   map[string]*BodyDocs
+}
+
+// BodyDocs documents a request or response body. Schemas and examples are
+// kept as decoded from the config so they can be written out as JSON.
+type BodyDocs struct {
+	Description string      `yaml:"description"`
+	ContentType string      `yaml:"content_type"`
+	Schema      interface{} `yaml:"schema"`
+	Example     interface{} `yaml:"example"`
+}
+
+type OpenAPIConfig struct {
+	Title   string
+	Version string
+	Path    string
+}
+
+type OpenAPIDocument struct {
+	OpenAPI string                     `json:"openapi"`
+	Info    OpenAPIInfo                `json:"info"`
+	Paths   map[string]OpenAPIPathItem `json:"paths"`
+}
+
+type OpenAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+// OpenAPIPathItem maps lowercase methods to operations
+type OpenAPIPathItem map[string]*OpenAPIOperation
+
+type OpenAPIOperation struct {
+	OperationID string                      `json:"operationId"`
+	Summary     string                      `json:"summary,omitempty"`
+	Description string                      `json:"description,omitempty"`
+	Parameters  []OpenAPIParameter          `json:"parameters,omitempty"`
+	RequestBody *OpenAPIRequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*OpenAPIResponse `json:"responses"`
+}
+
+type OpenAPIParameter struct {
+	Name     string                 `json:"name"`
+	In       string                 `json:"in"`
+	Required bool                   `json:"required"`
+	Schema   map[string]interface{} `json:"schema"`
+}
+
+type OpenAPIRequestBody struct {
+	Description string                      `json:"description,omitempty"`
+	Content     map[string]OpenAPIMediaType `json:"content"`
+}
+
+type OpenAPIResponse struct {
+	Description string                      `json:"description"`
+	Content     map[string]OpenAPIMediaType `json:"content,omitempty"`
+}
+
+type OpenAPIMediaType struct {
+	Schema  interface{} `json:"schema,omitempty"`
+	Example interface{} `json:"example,omitempty"`
+}
+
+// NewOpenAPIDocument builds an OpenAPI document from the endpoints attached
+// to the router. Each operation is documented by the last route of its
+// pipeline. Endpoints that only differ by host share a path, the first one
+// attached is documented.
+func NewOpenAPIDocument(router *mux.Router, config OpenAPIConfig) (*OpenAPIDocument, error) {
+	endpoints, err := Endpoints(router)
+	if err != nil {
+		return nil, err
+	}
+
+	document := &OpenAPIDocument{
+		OpenAPI: OpenAPIVersion,
+		Info: OpenAPIInfo{
+			Title:   config.Title,
+			Version: config.Version,
+		},
+		Paths: make(map[string]OpenAPIPathItem),
+	}
+	if document.Info.Title == "" {
+		document.Info.Title = DefaultOpenAPITitle
+	}
+	if document.Info.Version == "" {
+		document.Info.Version = DefaultOpenAPIVersion
+	}
+
+	for _, endpoint := range endpoints {
+		path, parameters := openAPIPath(endpoint)
+
+		item, ok := document.Paths[path]
+		if !ok {
+			item = make(OpenAPIPathItem)
+			document.Paths[path] = item
+		}
+
+		docs := endpoint.Pipeline.Docs()
+		rules := endpoint.Pipeline.Rules()
+		parameters = openAPIRulesParameters(parameters, rules)
+
+		requestBody := openAPIRequestBody(docs.RequestBody)
+		if requestBody == nil {
+			requestBody = openAPIRulesRequestBody(rules)
+		}
+
+		for _, method := range endpoint.Methods {
+			method = strings.ToLower(method)
+			if _, ok := item[method]; ok {
+				continue
+			}
+
+			item[method] = &OpenAPIOperation{
+				OperationID: PathToName(fmt.Sprintf("%s-%s", method, path)),
+				Summary:     docs.Summary,
+				Description: docs.Description,
+				Parameters:  parameters,
+				RequestBody: requestBody,
+				Responses:   openAPIResponses(docs.Responses),
+			}
+		}
+	}
+
+	return document, nil
+}
+
+// OpenAPIHandler serves the document as JSON
+func OpenAPIHandler(document *OpenAPIDocument) (http.Handler, error) {
+	b, err := json.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("handling route %s", r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	}), nil
+}
+
+// openAPIPath converts mux variables like "{id:[0-9]+}" to "{id}" and
+// returns a parameter for each variable and query matcher
+func openAPIPath(endpoint Endpoint) (string, []OpenAPIParameter) {
+	var parameters []OpenAPIParameter
+
+	path := routeVariableRegexp.ReplaceAllStringFunc(endpoint.Path, func(variable string) string {
+		match := routeVariableRegexp.FindStringSubmatch(variable)
+		schema := map[string]interface{}{"type": "string"}
+		if match[2] != "" {
+			schema["pattern"] = fmt.Sprintf("^%s$", match[2])
+		}
+
+		parameters = append(parameters, OpenAPIParameter{
+			Name:     match[1],
+			In:       "path",
+			Required: true,
+			Schema:   schema,
+		})
+		return fmt.Sprintf("{%s}", match[1])
+	})
+
+	for _, query := range endpoint.Queries {
+		name := strings.SplitN(query, "=", 2)[0]
+		parameters = append(parameters, OpenAPIParameter{
+			Name:     name,
+			In:       "query",
+			Required: true,
+			Schema:   map[string]interface{}{"type": "string"},
+		})
+	}
+
+	return path, parameters
+}
+
+// openAPIRulesParameters adds the patterns, query parameters and required
+// headers of the request rules to the parameters
+func openAPIRulesParameters(parameters []OpenAPIParameter, rules []*RequestRules) []OpenAPIParameter {
+	for _, rule := range rules {
+		for i, parameter := range parameters {
+			if re, ok := rule.Params[parameter.Name]; ok && parameter.In == "path" {
+				parameters[i].Schema = map[string]interface{}{"type": "string", "pattern": re.String()}
+			}
+		}
+
+		names := make([]string, 0, len(rule.Query))
+		for name := range rule.Query {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			parameters = setOpenAPIParameter(parameters, OpenAPIParameter{
+				Name:     name,
+				In:       "query",
+				Required: rule.Query[name].Required,
+				Schema:   map[string]interface{}{"type": rule.Query[name].Type},
+			})
+		}
+
+		for _, header := range rule.Headers {
+			parameters = setOpenAPIParameter(parameters, OpenAPIParameter{
+				Name:     header,
+				In:       "header",
+				Required: true,
+				Schema:   map[string]interface{}{"type": "string"},
+			})
+		}
+	}
+	return parameters
+}
+
+// setOpenAPIParameter replaces the parameter with the same name and location,
+// so rules of inner routes override matchers and rules of outer routes
+func setOpenAPIParameter(parameters []OpenAPIParameter, parameter OpenAPIParameter) []OpenAPIParameter {
+	for i, p := range parameters {
+		if p.In != parameter.In {
+			continue
+		}
+		if p.Name == parameter.Name || (p.In == "header" && strings.EqualFold(p.Name, parameter.Name)) {
+			parameters[i] = parameter
+			return parameters
+		}
+	}
+	return append(parameters, parameter)
+}
+
+// openAPIRulesRequestBody documents the request body with the schema of the
+// innermost request rules
+func openAPIRulesRequestBody(rules []*RequestRules) *OpenAPIRequestBody {
+	for i := len(rules) - 1; i >= 0; i-- {
+		if rules[i].SchemaSource == nil {
+			continue
+		}
+
+		contentType := "application/json"
+		if len(rules[i].ContentTypes) > 0 {
+			contentType = rules[i].ContentTypes[0]
+		}
+		return openAPIRequestBody(&BodyDocs{ContentType: contentType, Schema: rules[i].SchemaSource})
+	}
+	return nil
+}
+
+func openAPIRequestBody(body *BodyDocs) *OpenAPIRequestBody {
+	if body == nil {
+		return nil
+	}
+
+	return &OpenAPIRequestBody{
+		Description: body.Description,
+		Content:     openAPIContent(body),
+	}
+}
+
+func openAPIResponses(responses map[string]*BodyDocs) map[string]*OpenAPIResponse {
+	if len(responses) == 0 {
+		return map[string]*OpenAPIResponse{
+			"200": {Description: http.StatusText(http.StatusOK)},
+		}
+	}
+
+	codes := make([]string, 0, len(responses))
+	for code := range responses {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+
+	converted := make(map[string]*OpenAPIResponse, len(responses))
+	for _, code := range codes {
+		body := responses[code]
+		if body == nil {
+			body = &BodyDocs{}
+		}
+
+		response := &OpenAPIResponse{
+			Description: body.Description,
+			Content:     openAPIContent(body),
+		}
+		if response.Description == "" {
+			response.Description = openAPIStatusText(code)
+		}
+		converted[code] = response
+	}
+	return converted
+}
+
+func openAPIContent(body *BodyDocs) map[string]OpenAPIMediaType {
+	if body.Schema == nil && body.Example == nil && body.ContentType == "" {
+		return nil
+	}
+
+	contentType := body.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+
+	return map[string]OpenAPIMediaType{
+		contentType: {Schema: body.Schema, Example: body.Example},
+	}
+}
+
+func openAPIStatusText(code string) string {
+	var status int
+	fmt.Sscanf(code, "%d", &status)
+	if text := http.StatusText(status); text != "" {
+		return text
+	}
+	return "Response"
+}
+
+// JSONValue converts values decoded from YAML into values that can be
+// encoded as JSON, maps with non string keys are rejected
+func JSONValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			k, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("key %v must be a string", key)
+			}
+
+			converted, err := JSONValue(item)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = converted
+		}
+		return m, nil
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, item := range v {
+			converted, err := JSONValue(item)
+			if err != nil {
+				return nil, err
+			}
+			s[i] = converted
+		}
+		return s, nil
+	default:
+		return value, nil
+	}
+}
@@ -0,0 +1,214 @@
+package switchboard
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	TagsOutput    = "tags"
+	JSONOutput    = "json"
+	DefaultOutput = TagsOutput
+)
+
+// OutputError is returned when a command's output cannot be parsed. These
+// errors respond with 502 Bad Gateway.
+type OutputError struct {
+	Command string
+	Err     error
+}
+
+func (err *OutputError) Error() string {
+	return fmt.Sprintf("command %s returned malformed output: %s", err.Command, err.Err)
+}
+
+func (err *OutputError) Unwrap() error {
+	return err.Err
+}
+
+// OutputEnvelope is the output of commands with "output: json". Every field
+// is optional and maps onto the equivalent tags:
+//
+//   status
+//   HTTP_STATUS_CODE
+//
+//   headers
+//   An object of header names to a value or an array of values,
+//   HTTP_HEADER_<NAME>
+//
+//   cookies
+//   An array of HTTP_SET_COOKIE strings, or objects with name, value, path,
+//   domain, max_age, expires, secure, http_only and same_site
+//
+//   env
+//   An object of variables, ENV_SET, or ENV_UNSET when the value is null
+//
+//   halt
+//   HALT
+//
+//   body, body_base64
+//   The body as a string, any other JSON value which is sent as JSON, or
+//   base64 encoded bytes. Only one of them may be set.
+//
+// The envelope must be a single JSON object without unknown fields.
+type OutputEnvelope struct {
+	Status     *int                       `json:"status"`
+	Headers    map[string]json.RawMessage `json:"headers"`
+	Cookies    []json.RawMessage          `json:"cookies"`
+	Env        map[string]*string         `json:"env"`
+	Halt       *bool                      `json:"halt"`
+	Body       json.RawMessage            `json:"body"`
+	BodyBase64 *string                    `json:"body_base64"`
+}
+
+type OutputCookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Path     string `json:"path"`
+	Domain   string `json:"domain"`
+	MaxAge   *int   `json:"max_age"`
+	Expires  string `json:"expires"`
+	Secure   bool   `json:"secure"`
+	HttpOnly bool   `json:"http_only"`
+	SameSite string `json:"same_site"`
+}
+
+// ParseJSONOutput converts a JSON envelope into tags and a body
+func ParseJSONOutput(stdout io.Reader) (Tags, io.Reader, error) {
+	decoder := json.NewDecoder(stdout)
+	decoder.DisallowUnknownFields()
+
+	var envelope OutputEnvelope
+	err := decoder.Decode(&envelope)
+	if err == io.EOF {
+		return nil, nil, errors.New("expected a JSON object, got no output")
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("invalid JSON envelope: %s", err)
+	}
+	if decoder.More() {
+		return nil, nil, errors.New("unexpected output after the JSON envelope")
+	}
+
+	return envelope.ToTags()
+}
+
+func (envelope *OutputEnvelope) ToTags() (Tags, io.Reader, error) {
+	tags := make(Tags)
+
+	if envelope.Status != nil {
+		if *envelope.Status < 100 || *envelope.Status > 599 {
+			return nil, nil, fmt.Errorf("invalid status %d", *envelope.Status)
+		}
+		tags["HTTP_STATUS_CODE"] = []string{strconv.Itoa(*envelope.Status)}
+	}
+
+	for name, raw := range envelope.Headers {
+		var values []string
+		var value string
+		if err := json.Unmarshal(raw, &value); err == nil {
+			values = []string{value}
+		} else if err := json.Unmarshal(raw, &values); err != nil {
+			return nil, nil, fmt.Errorf("header %s must be a string or an array of strings", name)
+		}
+		key := HeaderTagPrefix + EnvName(name)
+		tags[key] = append(tags[key], values...)
+	}
+
+	for i, raw := range envelope.Cookies {
+		value, err := outputCookie(raw)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cookie %d: %s", i, err)
+		}
+
+		if _, err := ParseSetCookie(value); err != nil {
+			return nil, nil, err
+		}
+		tags["HTTP_SET_COOKIE"] = append(tags["HTTP_SET_COOKIE"], value)
+	}
+
+	for key, value := range envelope.Env {
+		if value == nil {
+			tags["ENV_UNSET"] = append(tags["ENV_UNSET"], key)
+		} else {
+			tags["ENV_SET"] = append(tags["ENV_SET"], fmt.Sprintf("%s=%s", key, *value))
+		}
+	}
+
+	if envelope.Halt != nil {
+		tags["HALT"] = []string{strconv.FormatBool(*envelope.Halt)}
+	}
+
+	var body []byte
+	hasBody := len(envelope.Body) > 0 && string(envelope.Body) != "null"
+	if hasBody && envelope.BodyBase64 != nil {
+		return nil, nil, errors.New("only one of body and body_base64 may be set")
+	}
+
+	switch {
+	case envelope.BodyBase64 != nil:
+		decoded, err := base64.StdEncoding.DecodeString(*envelope.BodyBase64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid body_base64: %s", err)
+		}
+		body = decoded
+	case hasBody && envelope.Body[0] == '"':
+		var s string
+		if err := json.Unmarshal(envelope.Body, &s); err != nil {
+			return nil, nil, fmt.Errorf("invalid body: %s", err)
+		}
+		body = []byte(s)
+	case hasBody:
+		body = envelope.Body
+		if _, ok := tags["HTTP_HEADER_CONTENT_TYPE"]; !ok {
+			tags["HTTP_CONTENT_TYPE"] = []string{"application/json"}
+		}
+	}
+
+	return tags, bytes.NewReader(body), nil
+}
+
+// outputCookie converts a cookie from the envelope to the HTTP_SET_COOKIE
+// format
+func outputCookie(raw json.RawMessage) (string, error) {
+	var value string
+	if err := json.Unmarshal(raw, &value); err == nil {
+		return value, nil
+	}
+
+	var cookie OutputCookie
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&cookie); err != nil {
+		return "", fmt.Errorf("must be a string or an object: %s", err)
+	}
+
+	attributes := []string{fmt.Sprintf("%s=%s", cookie.Name, cookie.Value)}
+	if cookie.Path != "" {
+		attributes = append(attributes, "Path="+cookie.Path)
+	}
+	if cookie.Domain != "" {
+		attributes = append(attributes, "Domain="+cookie.Domain)
+	}
+	if cookie.MaxAge != nil {
+		attributes = append(attributes, fmt.Sprintf("Max-Age=%d", *cookie.MaxAge))
+	}
+	if cookie.Expires != "" {
+		attributes = append(attributes, "Expires="+cookie.Expires)
+	}
+	if cookie.Secure {
+		attributes = append(attributes, "Secure")
+	}
+	if cookie.HttpOnly {
+		attributes = append(attributes, "HttpOnly")
+	}
+	if cookie.SameSite != "" {
+		attributes = append(attributes, "SameSite="+cookie.SameSite)
+	}
+	return strings.Join(attributes, "; "), nil
+}
@@ -0,0 +1,156 @@
+package switchboard
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	JSONMerge   = "json"
+	ConcatMerge = "concat"
+	FirstMerge  = "first"
+
+	DefaultMerge = JSONMerge
+)
+
+// Parallel runs several commands at the same time with the same environment
+// and STDIN and merges their output into a single stage result.
+//
+// Merge strategies:
+//
+//   json
+//   Each output is parsed as JSON and nested in an object under the
+//   command's name, e.g. { "users": [...], "stats": {...} }
+//
+//   concat
+//   Outputs are concatenated in the order the commands are defined
+//
+//   first
+//   The output of the first command to succeed is used as is
+//
+// For json and concat, tags are combined in the order the commands are
+// defined. Later commands override earlier ones, except HTTP_STATUS_CODE
+// where the highest status wins, and the env tags, DEBUG, HTTP_SET_COOKIE,
+// HTTP_UNSET_HEADER and CACHE_PURGE where all values are kept. HALT is set if any
+// command halts.
+type Parallel struct {
+	Names    []string
+	Commands []*Command
+	Merge    string
+}
+
+type parallelResult struct {
+	index int
+	tags  Tags
+	body  string
+	err   error
+}
+
+func (parallel *Parallel) Handle(r *http.Request, path string, env []string, stdin io.Reader) (Tags, string, error) {
+	input, err := ioutil.ReadAll(stdin)
+	if err != nil {
+		return nil, "", err
+	}
+
+	results := make(chan parallelResult, len(parallel.Commands))
+	for i, command := range parallel.Commands {
+		go func(i int, command *Command) {
+			tags, body, err := HandleCommand(command, r, path, env, bytes.NewReader(input))
+			results <- parallelResult{i, tags, body, err}
+		}(i, command)
+	}
+
+	if parallel.Merge == FirstMerge {
+		var first *parallelResult
+		for range parallel.Commands {
+			result := <-results
+			if result.err == nil {
+				log.Printf("using output of %s for route %s", parallel.Names[result.index], path)
+				return result.tags, result.body, nil
+			}
+			if first == nil || result.index < first.index {
+				first = &result
+			}
+		}
+		return nil, first.body, first.err
+	}
+
+	ordered := make([]parallelResult, len(parallel.Commands))
+	for range parallel.Commands {
+		result := <-results
+		ordered[result.index] = result
+	}
+
+	tags := make(Tags)
+	for _, result := range ordered {
+		if result.err != nil {
+			return nil, result.body, result.err
+		}
+		mergeTags(tags, result.tags)
+	}
+
+	switch parallel.Merge {
+	case ConcatMerge:
+		var body strings.Builder
+		for _, result := range ordered {
+			body.WriteString(result.body)
+		}
+		return tags, body.String(), nil
+	case JSONMerge, "":
+		merged := make(map[string]json.RawMessage, len(ordered))
+		for _, result := range ordered {
+			name := parallel.Names[result.index]
+			if !json.Valid([]byte(result.body)) {
+				return nil, "", fmt.Errorf("output of %s is not valid JSON", name)
+			}
+			merged[name] = json.RawMessage(result.body)
+		}
+
+		body, err := json.Marshal(merged)
+		if err != nil {
+			return nil, "", err
+		}
+
+		if _, ok := tags["HTTP_CONTENT_TYPE"]; !ok {
+			tags["HTTP_CONTENT_TYPE"] = []string{"application/json"}
+		}
+		return tags, string(body), nil
+	default:
+		return nil, "", fmt.Errorf("unsupported merge strategy \"%s\"", parallel.Merge)
+	}
+}
+
+func mergeTags(tags Tags, other Tags) {
+	for key, values := range other {
+		switch key {
+		case "HTTP_STATUS_CODE":
+			current, _ := strconv.Atoi(last(tags[key]))
+			status, _ := strconv.Atoi(last(values))
+			if status > current {
+				tags[key] = values
+			}
+		case "ENV_SET", "ENV_UNSET", "ENV_APPEND", "DEBUG", "HTTP_SET_COOKIE", "HTTP_UNSET_HEADER", "CACHE_PURGE":
+			tags[key] = append(tags[key], values...)
+		case "HALT":
+			if last(tags[key]) != "true" {
+				tags[key] = values
+			}
+		default:
+			tags[key] = values
+		}
+	}
+}
+
+func last(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[len(values)-1]
+}
@@ -1,12 +1,15 @@
 package switchboard
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/gorilla/mux"
@@ -14,41 +17,93 @@ import (
 
 type Route interface {
 	AttachHandlers(*mux.Router, Pipeline) error
-	Handle([]string, io.Reader) (Tags, string, error)
+	Handle(*http.Request, []string, io.Reader) (Tags, string, error)
+	After() []*Command
 }
 
 type BasicRoute struct {
-	Path    string
-	Command *Command
-	Methods []string
-	Type    string
-	Routes  map[string]Route
+	Path           string
+	Command        *Command
+	Handlers       map[string]*Command
+	Parallel       *Parallel
+	BeforeCommands []*Command
+	AfterCommands  []*Command
+	Methods        []string
+	Matchers       Matchers
+	Settings       RouteSettings
+	Docs           RouteDocs
+	Request        *RequestRules
+	Cache          *CacheRules
+	ETag           string
+	Form           *FormRules
+	Type           string
+	Routes         []Route
 }
 
 type ResourceRoute struct {
-	Path    string
-	Command *Command
-	Routes  map[string]Route
+	Path              string
+	Command           *Command
+	BeforeCommands    []*Command
+	AfterCommands     []*Command
+	Matchers          Matchers
+	Settings          RouteSettings
+	Docs              RouteDocs
+	Request           *RequestRules
+	Cache             *CacheRules
+	ETag              string
+	Form              *FormRules
+	Param             string
+	Pattern           string
+	NestedParam       string
+	CollectionMethods []string
+	MemberMethods     []string
+	Collection        []Route
+	Member            []Route
+	Routes            []Route
 }
 
 type RootRoute struct {
-	Routes map[string]Route
+	Routes []Route
 }
 
 type Pipeline []Route
 
 func (route *BasicRoute) AttachHandlers(router *mux.Router, pipeline Pipeline) error {
-	for _, method := range route.Methods {
-		if len(route.Routes) == 0 {
+	router = route.Matchers.Subrouter(router)
+	pipeline = pipeline.AppendBefore(route.Path, route.BeforeCommands, route.Settings)
+
+	// Routes with per method commands are always routable, other routes are
+	// only routable when they have no child routes
+	if len(route.Handlers) > 0 || len(route.Routes) == 0 {
+		methods := make([]string, 0, len(route.Handlers))
+		for method := range route.Handlers {
+			methods = append(methods, method)
+		}
+		sort.Strings(methods)
+
+		for _, method := range methods {
 			log.Printf("routing to %s %s", method, route.Path)
-			router.HandleFunc(route.Path, pipeline.Append(route).Handle).Methods(method)
-		} else {
-			log.Printf("inserting route in pipeline %s", route.Path)
-			for _, child := range route.Routes {
-				err := child.AttachHandlers(router, pipeline.Append(route))
-				if err != nil {
-					return err
-				}
+			handler := route.withCommand(route.Handlers[method])
+			router.Handle(route.Path, pipeline.Append(handler)).Methods(method)
+		}
+
+		// Without a command of its own the route would pass the body through
+		// for methods that have no handler, those respond with 405 instead
+		for _, method := range route.Methods {
+			if _, ok := route.Handlers[method]; ok || (route.Command == nil && route.Parallel == nil) {
+				continue
+			}
+			log.Printf("routing to %s %s", method, route.Path)
+			router.Handle(route.Path, pipeline.Append(route)).Methods(method)
+		}
+	}
+
+	if len(route.Routes) > 0 {
+		log.Printf("inserting route in pipeline %s", route.Path)
+		for _, child := range route.Routes {
+			err := child.AttachHandlers(router, pipeline.Append(route))
+			if err != nil {
+				return err
 			}
 		}
 	}
@@ -56,40 +111,62 @@ func (route *BasicRoute) AttachHandlers(router *mux.Router, pipeline Pipeline) e
 	return nil
 }
 
-func (route *BasicRoute) Handle(env []string, stdin io.Reader) (Tags, string, error) {
-	log.Printf("executing command %s for route %s", route.Command.Name, route.Path)
-	status, routeTags, stdout, err := route.Command.Execute(env, stdin)
-	if err != nil {
-		log.Printf("failed to execute command: %s", err)
-		return nil, "", err
-	}
+func (route *BasicRoute) withCommand(command *Command) *BasicRoute {
+	r := *route
+	r.Command = command
+	return &r
+}
 
-	body, err := ioutil.ReadAll(stdout)
-	if err != nil {
-		log.Print("command failed to execute correctly")
-		return nil, "", err
+func (route *BasicRoute) Handle(r *http.Request, env []string, stdin io.Reader) (Tags, string, error) {
+	if route.Parallel != nil {
+		env = append(append([]string{}, env...), route.Settings.EnvList()...)
+		return route.Parallel.Handle(r, route.Path, env, stdin)
 	}
 
-	if status != 0 {
-		log.Printf("command completed with a nonzero exit status %d", status)
-		return nil, string(body), err
+	// Routes that only define per method commands pass through to their
+	// child routes
+	if route.Command == nil {
+		body, err := ioutil.ReadAll(stdin)
+		if err != nil {
+			return nil, "", err
+		}
+		return nil, string(body), nil
 	}
 
-	return routeTags, string(body), nil
+	env = append(append([]string{}, env...), route.Settings.EnvList()...)
+	return HandleCommand(route.Command, r, route.Path, env, stdin)
+}
+
+func (route *BasicRoute) After() []*Command {
+	return route.AfterCommands
 }
 
 func (route *ResourceRoute) AttachHandlers(router *mux.Router, pipeline Pipeline) error {
+	router = route.Matchers.Subrouter(router)
+	pipeline = pipeline.AppendBefore(route.Path, route.BeforeCommands, route.Settings)
+
 	resourcesPath := route.Path
-	resourcePath := fmt.Sprintf("%s/:id", resourcesPath)
+	resourcePath := route.MemberPath()
+
+	// Actions are attached first so static segments like "/users/search" take
+	// precedence over the member path "/users/{id}"
+	for _, actions := range [][]Route{route.Collection, route.Member} {
+		for _, action := range actions {
+			err := action.AttachHandlers(router, pipeline.Copy())
+			if err != nil {
+				return err
+			}
+		}
+	}
 
-	for _, method := range []string{"GET", "POST"} {
+	for _, method := range route.CollectionMethods {
 		log.Printf("routing to %s %s", method, resourcesPath)
-		router.HandleFunc(resourcesPath, pipeline.Append(route).Handle).Methods(method)
+		router.Handle(resourcesPath, pipeline.Append(route)).Methods(method)
 	}
 
-	for _, method := range []string{"GET", "PUT", "PATCH", "DELETE"} {
+	for _, method := range route.MemberMethods {
 		log.Printf("routing to %s %s", method, resourcePath)
-		router.HandleFunc(resourcePath, pipeline.Append(route).Handle).Methods(method)
+		router.Handle(resourcePath, pipeline.Append(route)).Methods(method)
 	}
 
 	if len(route.Routes) > 0 {
@@ -105,26 +182,34 @@ func (route *ResourceRoute) AttachHandlers(router *mux.Router, pipeline Pipeline
 	return nil
 }
 
-func (route *ResourceRoute) Handle(env []string, stdin io.Reader) (Tags, string, error) {
-	log.Printf("executing command %s for route %s", route.Command.Name, route.Path)
-	status, routeTags, stdout, err := route.Command.Execute(env, stdin)
-	if err != nil {
-		log.Print("failed to execute command: %s", err)
-		return nil, "", err
-	}
+// MemberPath returns the path of a single resource, e.g. "/users/{id}"
+func (route *ResourceRoute) MemberPath() string {
+	return fmt.Sprintf("%s/%s", route.Path, route.variable(route.Param))
+}
 
-	body, err := ioutil.ReadAll(stdout)
-	if err != nil {
-		log.Print("command failed to execute correctly")
-		return nil, "", err
-	}
+// NestedPath returns the path child routes are nested under, e.g.
+// "/users/{user_id}"
+func (route *ResourceRoute) NestedPath() string {
+	return fmt.Sprintf("%s/%s", route.Path, route.variable(route.NestedParam))
+}
 
-	if status != 0 {
-		log.Printf("command completed with a nonzero exit status %d", status)
-		return nil, string(body), err
+func (route *ResourceRoute) variable(name string) string {
+	if name == "" {
+		name = DefaultResourceParam
+	}
+	if route.Pattern == "" {
+		return fmt.Sprintf("{%s}", name)
 	}
+	return fmt.Sprintf("{%s:%s}", name, route.Pattern)
+}
 
-	return routeTags, string(body), nil
+func (route *ResourceRoute) Handle(r *http.Request, env []string, stdin io.Reader) (Tags, string, error) {
+	env = append(append([]string{}, env...), route.Settings.EnvList()...)
+	return HandleCommand(route.Command, r, route.Path, env, stdin)
+}
+
+func (route *ResourceRoute) After() []*Command {
+	return route.AfterCommands
 }
 
 func (route *RootRoute) AttachHandlers(router *mux.Router, pipeline Pipeline) error {
@@ -135,48 +220,247 @@ func (route *RootRoute) AttachHandlers(router *mux.Router, pipeline Pipeline) er
 	return nil
 }
 
-func (route *RootRoute) Handle([]string, io.Reader) (Tags, string, error) {
+func (route *RootRoute) Handle(*http.Request, []string, io.Reader) (Tags, string, error) {
 	return nil, "", errors.New("root route cannot be executed")
 }
 
+func (route *RootRoute) After() []*Command {
+	return nil
+}
+
+func HandleCommand(command *Command, r *http.Request, path string, env []string, stdin io.Reader) (Tags, string, error) {
+	log.Printf("executing command %s for route %s", command.Name, path)
+	stdin, err := CommandInput(command, r, stdin)
+	if err != nil {
+		return nil, "", &CommandError{Command: command.Name, Route: path, ExitCode: -1, Err: err}
+	}
+
+	logger := RequestLogger(r).With("route", path, "command", command.Name)
+	status, routeTags, stdout, err := command.Execute(logger, env, stdin)
+	if err != nil {
+		log.Printf("failed to execute command: %s", err)
+		return nil, "", &CommandError{Command: command.Name, Route: path, ExitCode: -1, Err: err}
+	}
+	LogTags(logger, routeTags)
+
+	body, err := ioutil.ReadAll(stdout)
+	if err != nil {
+		log.Print("command failed to execute correctly")
+		return nil, "", &CommandError{Command: command.Name, Route: path, ExitCode: -1, Err: err}
+	}
+
+	if status != 0 {
+		log.Printf("command completed with a nonzero exit status %d", status)
+		return nil, string(body), &CommandError{Command: command.Name, Route: path, ExitCode: status}
+	}
+
+	return routeTags, string(body), nil
+}
+
 func (pipeline Pipeline) Handle(w http.ResponseWriter, r *http.Request) {
 	log.Printf("handling route %s", r.URL.Path)
 	env := RequestToEnv(r)
-	tags := make(Tags)
-	stdin := io.Reader(r.Body)
 
-	for _, route := range pipeline {
-		routeTags, body, err := route.Handle(env, stdin)
+	stdin, verr := pipeline.Validate(r)
+	var form *Form
+	if verr == nil {
+		form, verr = ParseForm(r, pipeline.FormRules(), stdin)
+	}
+	if verr != nil {
+		log.Printf("rejected invalid request: %s", verr)
+		herr := NewHandlerError(r, verr.Status, verr, verr.Body())
+		herr.ContentType = "application/json"
+		HandleError(w, r, env, herr)
+		return
+	}
+
+	if form != nil {
+		defer form.Remove()
+		env = append(env, form.Env...)
+		stdin = bytes.NewReader(form.Body)
+	}
+
+	if recorder := NewCacheRecorder(w, r, pipeline.CacheRules()); recorder != nil {
+		pipeline.Run(recorder, r, env, make(Tags), stdin)
+		recorder.Store()
+		return
+	}
+
+	pipeline.Run(w, r, env, make(Tags), stdin)
+}
+
+// Run executes the pipeline with the given environment, tags and STDIN and
+// writes the response. Responses with a FORWARD tag are dispatched to the
+// forwarded route instead, without running this pipeline's after commands.
+func (pipeline Pipeline) Run(w http.ResponseWriter, r *http.Request, env []string, tags Tags, stdin io.Reader) {
+	// Only routes that were executed run their after commands
+	initial := env
+	executed := 0
+	for i, route := range pipeline {
+		// Cached responses are looked up once every earlier stage passed
+		if recorder, ok := w.(*CacheRecorder); ok && i == len(pipeline)-1 && recorder.Lookup(r, initial, env, tags) {
+			return
+		}
+
+		executed++
+
+		routeTags, body, err := route.Handle(r, env, stdin)
 		if err != nil {
-			if body == "" {
-				body = err.Error()
-			}
-			http.Error(w, body, http.StatusInternalServerError)
+			HandleError(w, r, env, NewHandlerError(r, ErrorStatus(err), err, body))
 			return
 		}
 
 		halt, err := ApplyBetweenTags(routeTags, tags, &env)
 		if err != nil {
 			log.Print("failed to apply tags")
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			HandleError(w, r, env, NewHandlerError(r, http.StatusInternalServerError, err, ""))
 			return
 		}
 
 		stdin = strings.NewReader(body)
 
+		// Unsafe requests are checked against the version reported by an
+		// earlier stage before the route's command changes it
+		if !halt && i < len(pipeline)-1 {
+			failed, err := StagePreconditionFailed(r, routeTags)
+			if err != nil {
+				HandleError(w, r, env, NewHandlerError(r, http.StatusInternalServerError, err, ""))
+				return
+			}
+			if failed {
+				log.Printf("precondition failed for %s", r.URL.Path)
+				tags["HTTP_STATUS_CODE"] = []string{strconv.Itoa(http.StatusPreconditionFailed)}
+				stdin = strings.NewReader("")
+				halt = true
+			}
+		}
+
 		if halt {
 			break
 		}
 	}
 
-	err := ApplyEndTags(tags, w)
+	// The forwarded route's after commands replace this pipeline's
+	if targets, ok := tags["FORWARD"]; ok {
+		delete(tags, "FORWARD")
+		Forward(w, r, env, tags, stdin, targets[len(targets)-1])
+		return
+	}
+
+	// After commands run from the innermost route outwards and receive the
+	// response built so far
+	halt := false
+	for i := executed - 1; i >= 0 && !halt; i-- {
+		route := pipeline[i]
+		for _, command := range route.After() {
+			afterEnv := append(append([]string{}, env...), routeSettings(route).EnvList()...)
+			afterEnv = append(afterEnv, TagsToEnv(tags)...)
+			routeTags, body, err := HandleCommand(command, r, r.URL.Path, afterEnv, stdin)
+			if err != nil {
+				HandleError(w, r, env, NewHandlerError(r, ErrorStatus(err), err, body))
+				return
+			}
+
+			halt, err = ApplyBetweenTags(routeTags, tags, &env)
+			if err != nil {
+				log.Print("failed to apply tags")
+				HandleError(w, r, env, NewHandlerError(r, http.StatusInternalServerError, err, ""))
+				return
+			}
+
+			stdin = strings.NewReader(body)
+
+			if halt {
+				break
+			}
+		}
+	}
+
+	if _, ok := tags["HTTP_ETAG"]; !ok && pipeline.AutoETag() && (r.Method == "GET" || r.Method == "HEAD") {
+		b, err := ioutil.ReadAll(stdin)
+		if err != nil {
+			HandleError(w, r, env, NewHandlerError(r, http.StatusInternalServerError, err, ""))
+			return
+		}
+		tags["HTTP_ETAG"] = []string{ETagFromBody(b)}
+		stdin = bytes.NewReader(b)
+	}
+
+	err := ApplyCacheTags(w, r, tags)
+	if err == nil {
+		err = ApplyEndTags(tags, w, r, stdin)
+	}
 	if err != nil {
 		log.Print("failed to apply tags")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		HandleError(w, r, env, NewHandlerError(r, http.StatusInternalServerError, err, ""))
 		return
 	}
+}
+
+func (pipeline Pipeline) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	pipeline.Handle(w, r)
+}
+
+// Names returns the names of the commands executed by the pipeline
+func (pipeline Pipeline) Names() []string {
+	names := make([]string, 0, len(pipeline))
+	for _, route := range pipeline {
+		switch r := route.(type) {
+		case *BasicRoute:
+			if r.Parallel != nil {
+				names = append(names, fmt.Sprintf("parallel(%s)", strings.Join(r.Parallel.Names, ", ")))
+			} else if r.Command != nil {
+				names = append(names, r.Command.Name)
+			}
+		case *ResourceRoute:
+			names = append(names, r.Command.Name)
+		}
+	}
+	return names
+}
 
-	io.Copy(w, stdin)
+// Settings returns the effective settings of the pipeline's last route
+func (pipeline Pipeline) Settings() RouteSettings {
+	if len(pipeline) == 0 {
+		return RouteSettings{}
+	}
+	return routeSettings(pipeline[len(pipeline)-1])
+}
+
+func routeSettings(route Route) RouteSettings {
+	switch r := route.(type) {
+	case *BasicRoute:
+		return r.Settings
+	case *ResourceRoute:
+		return r.Settings
+	default:
+		return RouteSettings{}
+	}
+}
+
+// Docs returns the documentation of the pipeline's last route
+func (pipeline Pipeline) Docs() RouteDocs {
+	if len(pipeline) == 0 {
+		return RouteDocs{}
+	}
+
+	switch r := pipeline[len(pipeline)-1].(type) {
+	case *BasicRoute:
+		return r.Docs
+	case *ResourceRoute:
+		return r.Docs
+	default:
+		return RouteDocs{}
+	}
+}
+
+// AppendBefore appends a stage for each command that runs before a route,
+// such as authentication
+func (pipeline Pipeline) AppendBefore(path string, commands []*Command, settings RouteSettings) Pipeline {
+	for _, command := range commands {
+		pipeline = pipeline.Append(&BasicRoute{Path: path, Command: command, Settings: settings})
+	}
+	return pipeline
 }
 
 func (pipeline Pipeline) Append(route Route) Pipeline {
@@ -218,18 +502,26 @@ func RequestToEnv(r *http.Request) []string {
 	}
 
 	for k, v := range r.Header {
-		k = strings.Replace(k, "-", "_", -1)
-		k = strings.ToUpper(k)
-		k = fmt.Sprintf("HTTP_HEADER_%s", k)
+		k = fmt.Sprintf("HTTP_HEADER_%s", EnvName(k))
 		env = append(env, fmt.Sprintf("%s=%s", k, strings.Join(v, ", ")))
 	}
 
-	for key, value := range mux.Vars(r) {
-		key = strings.Replace(key, "-", "_", -1)
-		key = strings.ToUpper(key)
-		key = fmt.Sprintf("HTTP_PARAM_%s", key)
-		env = append(env, fmt.Sprintf("%s=%s", key, value))
+	if id := RequestID(r); id != "" {
+		env = append(env, fmt.Sprintf("HTTP_REQUEST_ID=%s", id))
 	}
 
+	env = append(env, ValuesToEnv("HTTP_QUERY_", r.URL.Query())...)
+	env = append(env, CookiesToEnv(r)...)
+	env = append(env, VarsToEnv(mux.Vars(r))...)
+
+	return env
+}
+
+func VarsToEnv(vars map[string]string) []string {
+	env := make([]string, 0, len(vars))
+	for key, value := range vars {
+		key = fmt.Sprintf("HTTP_PARAM_%s", EnvName(key))
+		env = append(env, fmt.Sprintf("%s=%s", key, value))
+	}
 	return env
 }
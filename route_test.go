@@ -1,12 +1,26 @@
 package switchboard_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
 	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
+	"github.com/andybalholm/brotli"
+	"github.com/urfave/cli"
 	"github.com/vanstee/switchboard"
 )
 
@@ -48,7 +62,7 @@ HTTP_STATUS_CODE: 201
 	if err != nil {
 		t.Fatalf("ioutil.ReadAll returned an error: %s", err)
 	}
-	if string(body) != "{ \"user\": { \"id\": 1, \"name\": \"Jimmy\" } }\n" {
+	if string(body) != "{ \"user\": { \"id\": 1, \"name\": \"Jimmy\" } }" {
 		t.Errorf("expected response body was incorrect")
 	}
 }
@@ -73,3 +87,1564 @@ func (driver FakeDriver) Execute(command *switchboard.Command, env []string, str
 
 	return driver.Status, driver.Err
 }
+
+// newTestConfig parses a test config, tabs are replaced so configs can be
+// indented with the test
+func newTestConfig(t *testing.T, body string) *switchboard.Config {
+	t.Helper()
+	config, err := switchboard.ParseConfig(strings.NewReader(strings.Replace(body, "\t", "  ", -1)))
+	if err != nil {
+		t.Fatalf("ParseConfig returned an error: %s", err)
+	}
+	return config
+}
+
+func newTestRouter(t *testing.T, body string) http.Handler {
+	t.Helper()
+	router, err := switchboard.BuildRouter(newTestConfig(t, body))
+	if err != nil {
+		t.Fatalf("BuildRouter returned an error: %s", err)
+	}
+	return router
+}
+
+// routeTest is a request to a test router and the response it expects. The
+// method defaults to GET, the response body is only checked when expected is
+// set and multiple header values are joined with ", ".
+type routeTest struct {
+	method          string
+	url             string
+	headers         map[string]string
+	body            string
+	status          int
+	expected        string
+	expectedHeaders map[string]string
+}
+
+func runRouteTests(t *testing.T, router http.Handler, tests []routeTest) {
+	t.Helper()
+	for _, test := range tests {
+		method := test.method
+		if method == "" {
+			method = "GET"
+		}
+
+		r := httptest.NewRequest(method, test.url, strings.NewReader(test.body))
+		for name, value := range test.headers {
+			r.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		if w.Code != test.status {
+			t.Errorf("%s %s expected response status to be %d, got %d", method, test.url, test.status, w.Code)
+		}
+		for name, expected := range test.expectedHeaders {
+			value := strings.Join(w.Header()[http.CanonicalHeaderKey(name)], ", ")
+			if value != expected {
+				t.Errorf("%s %s expected %s header to equal %#v, got %#v", method, test.url, name, expected, value)
+			}
+		}
+		if test.expected != "" && w.Body.String() != test.expected {
+			t.Errorf("%s %s expected response body to be %#v, got %#v", method, test.url, test.expected, w.Body.String())
+		}
+	}
+}
+
+func TestResourceRoutes(t *testing.T) {
+	router := newTestRouter(t, `
+commands:
+	params:
+		inline: |
+			echo "$HTTP_METHOD $HTTP_PARAM_ID $HTTP_PARAM_USER_ID"
+routes:
+	"/users":
+		type: resource
+		command: params
+		pattern: "[0-9]+"
+		member_methods: [GET, DELETE]
+		collection:
+			"/search":
+				method: GET
+		member:
+			"/activate":
+				method: POST
+		routes:
+			"/posts":
+				type: resource
+				command: params`)
+
+	runRouteTests(t, router, []routeTest{
+		{method: "GET", url: "/users", status: 200, expected: "GET  \n"},
+		{method: "GET", url: "/users/1", status: 200, expected: "GET 1 \n"},
+		{method: "DELETE", url: "/users/1", status: 200, expected: "DELETE 1 \n"},
+		{method: "PUT", url: "/users/1", status: 405},
+		{method: "GET", url: "/users/abc", status: 404},
+		{method: "GET", url: "/users/search", status: 200, expected: "GET  \n"},
+		{method: "POST", url: "/users/1/activate", status: 200, expected: "POST 1 \n"},
+		{method: "GET", url: "/users/1/posts/2", status: 200, expected: "GET 2 1\n"},
+	})
+}
+
+func TestDetectConflicts(t *testing.T) {
+	config := newTestConfig(t, `
+commands:
+	hello:
+		command: "echo hello"
+routes:
+	"/users/{id}":
+		command: hello
+	"/users/new":
+		command: hello
+	"/users/{name}":
+		command: hello
+	"/users/{id:[0-9]+}/posts":
+		command: hello
+		method: POST
+	"/users/1/posts":
+		command: hello
+	"/items/{id}":
+		command: hello
+		headers:
+			X-Version: "1"
+	"/items/{name}":
+		command: hello
+		headers:
+			X-Version: "2"
+	"/items/new":
+		command: hello
+		headers:
+			X-Version: "1"
+	"/secure/{id}":
+		command: hello
+		schemes: [https]
+	"/secure/new":
+		command: hello
+		schemes: [https]
+	"/{path:.*}":
+		command: hello
+	"/hello":
+		command: hello`)
+
+	router, err := switchboard.NewRouter(config, nil)
+	if err != nil {
+		t.Fatalf("NewRouter returned an error: %s", err)
+	}
+
+	conflicts, err := switchboard.DetectConflicts(router)
+	if err != nil {
+		t.Fatalf("DetectConflicts returned an error: %s", err)
+	}
+
+	expected := []string{
+		"GET /users/new is shadowed by /users/{id}",
+		"GET /users/{name} duplicates /users/{id}",
+		"GET /items/new is shadowed by /items/{id}",
+		"GET /secure/new is shadowed by /secure/{id}",
+		"GET /hello is shadowed by /{path:.*}",
+	}
+	if len(conflicts) != len(expected) {
+		t.Fatalf("expected %d conflicts, got %v", len(expected), conflicts)
+	}
+	for i, conflict := range conflicts {
+		if conflict.String() != expected[i] {
+			t.Errorf("expected conflict %#v, got %#v", expected[i], conflict.String())
+		}
+	}
+}
+
+func TestRouteMatchers(t *testing.T) {
+	router := newTestRouter(t, `
+commands:
+	tenant:
+		inline: |
+			echo "$HTTP_PARAM_TENANT $HTTP_PARAM_VERSION"
+routes:
+	"*":
+		host: "{tenant}.example.com"
+		command:
+			command: "cat"
+		routes:
+			"/api":
+				command: tenant
+				queries:
+					version: "{version:v[0-9]+}"
+			"/secure":
+				command: tenant
+				schemes: [https]
+				headers:
+					X-Api-Key: ""`)
+
+	runRouteTests(t, router, []routeTest{
+		{url: "http://acme.example.com/api?version=v2", status: 200, expected: "acme v2\n"},
+		{url: "http://acme.example.com/api?version=latest", status: 404},
+		{url: "http://acme.example.org/api?version=v2", status: 404},
+		{url: "https://acme.example.com/secure", headers: map[string]string{"X-Api-Key": "secret"}, status: 200, expected: "acme \n"},
+		{url: "https://acme.example.com/secure", status: 404},
+		{url: "http://acme.example.com/secure", headers: map[string]string{"X-Api-Key": "secret"}, status: 404},
+	})
+}
+
+func TestMethodCommands(t *testing.T) {
+	router := newTestRouter(t, `
+routes:
+	"/users":
+		methods:
+			GET:
+				inline: echo list
+			post:
+				inline: echo create
+		routes:
+			"/{id}":
+				command:
+					inline: echo "show $HTTP_PARAM_ID"
+	"/items":
+		method: [GET, POST]
+		methods:
+			GET:
+				inline: echo items
+	"/api":
+		type: group
+		method: [GET, POST]
+		routes:
+			"/users":
+				methods:
+					GET:
+						inline: echo users`)
+
+	runRouteTests(t, router, []routeTest{
+		{method: "GET", url: "/users", status: 200, expected: "list\n", expectedHeaders: map[string]string{"Allow": ""}},
+		{method: "POST", url: "/users", status: 200, expected: "create\n", expectedHeaders: map[string]string{"Allow": ""}},
+		{method: "DELETE", url: "/users", status: 405, expectedHeaders: map[string]string{"Allow": "GET, POST"}},
+		{method: "GET", url: "/users/1", status: 200, expected: "show 1\n", expectedHeaders: map[string]string{"Allow": ""}},
+		{method: "PUT", url: "/users/1", status: 405, expectedHeaders: map[string]string{"Allow": "GET"}},
+		{method: "GET", url: "/items", status: 200, expected: "items\n", expectedHeaders: map[string]string{"Allow": ""}},
+		{method: "POST", url: "/items", status: 405, expectedHeaders: map[string]string{"Allow": "GET"}},
+		{method: "GET", url: "/api/users", status: 200, expected: "users\n", expectedHeaders: map[string]string{"Allow": ""}},
+		{method: "POST", url: "/api/users", status: 405, expectedHeaders: map[string]string{"Allow": "GET"}},
+	})
+}
+
+func TestAfterCommands(t *testing.T) {
+	router := newTestRouter(t, `
+routes:
+	"*":
+		command:
+			command: cat
+		after:
+			- inline: |
+					echo "HTTP_CONTENT_TYPE: text/html"
+					echo
+					echo "<p>$(cat)</p>"
+		routes:
+			"/hello":
+				command:
+					inline: |
+						echo "HTTP_STATUS_CODE: 201"
+						echo
+						echo "hello"
+				after:
+					- inline: |
+							echo "HTTP_STATUS_CODE: $((TAG_HTTP_STATUS_CODE + 1))"
+							echo
+							tr a-z A-Z`)
+
+	runRouteTests(t, router, []routeTest{
+		{url: "/hello", status: 202, expected: "<p>HELLO</p>\n", expectedHeaders: map[string]string{"Content-Type": "text/html"}},
+	})
+}
+
+func TestErrorHandlers(t *testing.T) {
+	router := newTestRouter(t, `
+not_found:
+	inline: |
+		echo "HTTP_CONTENT_TYPE: application/json"
+		echo
+		echo "{ \"status\": $ERROR_STATUS, \"path\": \"$HTTP_URL_PATH\" }"
+method_not_allowed:
+	inline: echo "$ERROR_MESSAGE"
+error:
+	inline: |
+		echo "HTTP_STATUS_CODE: 503"
+		echo
+		echo "$ERROR_ROUTE $ERROR_EXIT_CODE $(cat)"
+routes:
+	"/fail":
+		command:
+			inline: |
+				echo partial
+				exit 3
+	"/fail-json":
+		command:
+			output: json
+			inline: |
+				echo not json
+				exit 4`)
+
+	runRouteTests(t, router, []routeTest{
+		{method: "GET", url: "/missing", status: 404, expected: "{ \"status\": 404, \"path\": \"/missing\" }\n"},
+		{method: "POST", url: "/fail", status: 405, expected: "Method Not Allowed\n"},
+		{method: "GET", url: "/fail", status: 503, expected: "/fail 3 partial\n"},
+		{method: "GET", url: "/fail-json", status: 503, expected: "/fail-json 4 not json\n"},
+	})
+}
+
+func TestGroupRoutes(t *testing.T) {
+	config := newTestConfig(t, `
+routes:
+	"/api":
+		type: group
+		env:
+			API_VERSION: "1"
+		method: [GET, POST]
+		timeout: 50ms
+		auth:
+			inline: |
+				if [ "$HTTP_HEADER_AUTHORIZATION" != "secret" ]; then
+					echo "HALT: true"
+					echo "HTTP_STATUS_CODE: 401"
+					echo
+					exit
+				fi
+		routes:
+			"/version":
+				command:
+					inline: echo "v$API_VERSION $HTTP_METHOD"
+			"/admin":
+				type: group
+				env:
+					API_VERSION: "2"
+				routes:
+					"/version":
+						command:
+							inline: echo "v$API_VERSION"
+			"/slow":
+				command:
+					inline: sleep 1
+	"/hooks":
+		type: group
+		env:
+			HOOK: after
+		after:
+			- inline: |
+					echo "HTTP_CONTENT_TYPE: text/plain"
+					echo
+					echo "$(cat) $HOOK"
+		routes:
+			"/run":
+				command:
+					inline: printf run
+	"/submit":
+		method: POST
+		command:
+			inline: echo submitted
+		routes:
+			"/status":
+				command:
+					inline: echo ok`)
+
+	router, err := switchboard.BuildRouter(config)
+	if err != nil {
+		t.Fatalf("BuildRouter returned an error: %s", err)
+	}
+
+	secret := map[string]string{"Authorization": "secret"}
+	runRouteTests(t, router, []routeTest{
+		{method: "GET", url: "/api/version", headers: secret, status: 200, expected: "v1 GET\n"},
+		{method: "POST", url: "/api/version", headers: secret, status: 200, expected: "v1 POST\n"},
+		{method: "GET", url: "/api/version", status: 401},
+		{method: "GET", url: "/api/admin/version", headers: secret, status: 200, expected: "v2\n"},
+		{method: "GET", url: "/api", headers: secret, status: 404},
+		{method: "GET", url: "/api/slow", headers: secret, status: 500},
+		{method: "GET", url: "/hooks/run", status: 200, expected: "run after\n"},
+		{method: "GET", url: "/submit/status", status: 200, expected: "ok\n"},
+		{method: "POST", url: "/submit/status", status: 405},
+	})
+
+	muxRouter, err := switchboard.NewRouter(config, nil)
+	if err != nil {
+		t.Fatalf("NewRouter returned an error: %s", err)
+	}
+
+	endpoints, err := switchboard.Endpoints(muxRouter)
+	if err != nil {
+		t.Fatalf("Endpoints returned an error: %s", err)
+	}
+
+	expected := "env: API_VERSION=1\ntimeout: 50ms\nmethods: GET,POST\nauth: api-auth-0"
+	for _, endpoint := range endpoints {
+		if endpoint.Path == "/api/version" && endpoint.Pipeline.Settings().String() != expected {
+			t.Errorf("expected /api/version settings to be %#v, got %#v", expected, endpoint.Pipeline.Settings().String())
+		}
+	}
+}
+
+func TestParallelRoutes(t *testing.T) {
+	router := newTestRouter(t, `
+routes:
+	"/dashboard":
+		parallel:
+			users:
+				inline: |
+					sleep 0.1
+					echo "HTTP_STATUS_CODE: 200"
+					echo
+					echo '[1, 2]'
+			stats:
+				inline: |
+					echo "HTTP_STATUS_CODE: 207"
+					echo
+					echo "{ \"path\": \"$HTTP_URL_PATH\" }"
+	"/concat":
+		method: POST
+		merge: concat
+		parallel:
+			a:
+				inline: sleep 0.1; echo "a $(cat)"
+			b:
+				inline: echo "b $(cat)"
+	"/first":
+		merge: first
+		parallel:
+			failing:
+				inline: exit 1
+			slow:
+				inline: sleep 0.2; echo slow
+			fast:
+				inline: sleep 0.05; echo fast`)
+
+	runRouteTests(t, router, []routeTest{
+		{method: "GET", url: "/dashboard", body: "input", status: 207, expected: "{\"stats\":{\"path\":\"/dashboard\"},\"users\":[1,2]}"},
+		{method: "POST", url: "/concat", body: "input", status: 200, expected: "a input\nb input\n"},
+		{method: "GET", url: "/first", body: "input", status: 200, expected: "fast\n"},
+	})
+}
+
+func TestForward(t *testing.T) {
+	router := newTestRouter(t, `
+routes:
+	"/old/{id}":
+		command:
+			inline: |
+				echo "FORWARD: /new/$HTTP_PARAM_ID?from=old"
+				echo "HTTP_CONTENT_TYPE: text/plain"
+				echo
+				echo "body"
+		after:
+			- inline: |
+					echo "HTTP_CONTENT_TYPE: text/html"
+					echo
+	"/new/{id}":
+		command:
+			inline: echo "$HTTP_PARAM_ID $HTTP_FORWARDED_FROM $(cat)"
+	"/loop/a":
+		command:
+			inline: |
+				echo "FORWARD: /loop/b"
+	"/loop/b":
+		command:
+			inline: |
+				echo "FORWARD: /loop/a"`)
+
+	runRouteTests(t, router, []routeTest{
+		{url: "/old/1", status: 200, expected: "1 /old/1 body\n", expectedHeaders: map[string]string{"Content-Type": "text/plain"}},
+		{url: "/loop/a", status: 508},
+	})
+}
+
+func TestOpenAPI(t *testing.T) {
+	router := newTestRouter(t, `
+openapi:
+	title: users
+	serve: true
+commands:
+	hello:
+		command: "echo hello"
+routes:
+	"/users":
+		type: resource
+		command: hello
+		pattern: "[0-9]+"
+		collection_methods: [GET]
+		member_methods: [GET]
+		summary: Users
+	"/hello":
+		command: hello
+		method: POST
+		summary: Say hello
+		request_body:
+			schema:
+				type: object
+				required: [name]
+		responses:
+			201:
+				content_type: text/plain
+				example: hello
+	"/search":
+		type: group
+		request:
+			headers: [X-Api-Key]
+			query:
+				page: integer
+		routes:
+			"/items":
+				command: hello
+				queries:
+					q: "{q}"
+				request:
+					headers: [x-api-key]
+					query:
+						q: string
+						page:
+							type: integer
+							required: true
+	"/{path:.*}":
+		command: hello`)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/openapi.json", nil))
+
+	resp := w.Result()
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected response status to be 200, got %d", resp.StatusCode)
+	}
+
+	document := switchboard.OpenAPIDocument{}
+	err := json.NewDecoder(resp.Body).Decode(&document)
+	if err != nil {
+		t.Fatalf("Decode returned an error: %s", err)
+	}
+
+	if document.Info.Title != "users" {
+		t.Errorf("expected title to be %#v, got %#v", "users", document.Info.Title)
+	}
+
+	member := document.Paths["/users/{id}"]["get"]
+	if member == nil {
+		t.Fatalf("expected GET /users/{id} to be documented, got %v", document.Paths)
+	}
+	if member.Summary != "Users" {
+		t.Errorf("expected GET /users/{id} summary to be %#v, got %#v", "Users", member.Summary)
+	}
+	if len(member.Parameters) != 1 || member.Parameters[0].Schema["pattern"] != "^[0-9]+$" {
+		t.Errorf("expected GET /users/{id} to have an id parameter, got %v", member.Parameters)
+	}
+
+	search := document.Paths["/search/items"]["get"]
+	if search == nil {
+		t.Fatalf("expected GET /search/items to be documented, got %v", document.Paths)
+	}
+	parameters := make([]string, len(search.Parameters))
+	for i, parameter := range search.Parameters {
+		parameters[i] = fmt.Sprintf("%s %s %t", parameter.In, parameter.Name, parameter.Required)
+	}
+	expected := "query q false, query page true, header x-api-key true"
+	if strings.Join(parameters, ", ") != expected {
+		t.Errorf("expected GET /search/items parameters to be %#v, got %#v", expected, strings.Join(parameters, ", "))
+	}
+
+	if document.Paths["/users"]["get"] == nil || document.Paths["/users"]["post"] != nil {
+		t.Errorf("expected only GET /users to be documented, got %v", document.Paths["/users"])
+	}
+
+	hello := document.Paths["/hello"]["post"]
+	if hello == nil {
+		t.Fatalf("expected POST /hello to be documented, got %v", document.Paths)
+	}
+	schema, _ := hello.RequestBody.Content["application/json"].Schema.(map[string]interface{})
+	if schema["type"] != "object" {
+		t.Errorf("expected POST /hello request schema to be an object, got %v", hello.RequestBody)
+	}
+	response := hello.Responses["201"]
+	if response == nil || response.Description != "Created" || response.Content["text/plain"].Example != "hello" {
+		t.Errorf("expected POST /hello to document a 201 response, got %v", hello.Responses)
+	}
+}
+
+func TestOpenAPICommand(t *testing.T) {
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("os.Pipe returned an error: %s", err)
+	}
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	output := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(r)
+		output <- b
+	}()
+
+	app := cli.NewApp()
+	app.Flags = []cli.Flag{cli.StringFlag{Name: "config"}}
+	app.Commands = []cli.Command{{Name: "openapi", Action: switchboard.OpenAPI}}
+	err = app.Run([]string{"switchboard", "--config", "examples/nesting.yaml", "openapi"})
+	w.Close()
+	b := <-output
+	if err != nil {
+		t.Fatalf("openapi returned an error: %s", err)
+	}
+
+	document := switchboard.OpenAPIDocument{}
+	if err := json.Unmarshal(b, &document); err != nil {
+		t.Fatalf("expected the openapi output to be JSON, got %s: %s", err, b)
+	}
+	if len(document.Paths) == 0 {
+		t.Errorf("expected the openapi output to document paths, got %s", b)
+	}
+}
+
+func TestRequestValidation(t *testing.T) {
+	router := newTestRouter(t, `
+routes:
+	"/users/{id}":
+		method: POST
+		command:
+			inline: cat
+		request:
+			max_body_size: 64
+			headers: [X-Api-Key]
+			content_types: [application/json]
+			query:
+				page: integer
+				sort:
+					type: string
+					required: true
+			params:
+				id: "[0-9]+"
+			schema:
+				type: object
+				required: [name]
+				properties:
+					name:
+						type: string
+	"/posts":
+		type: resource
+		command:
+			inline: cat
+		request:
+			schema:
+				type: object`)
+
+	for _, test := range []struct {
+		method      string
+		path        string
+		contentType string
+		apiKey      string
+		body        string
+		status      int
+		field       string
+	}{
+		{"POST", "/users/1?sort=name", "application/json", "key", `{"name": "jane"}`, 200, ""},
+		{"POST", "/users/1?sort=name", "application/json", "", `{"name": "jane"}`, 400, "X-Api-Key"},
+		{"POST", "/users/1?sort=name", "text/plain", "key", `{"name": "jane"}`, 415, ""},
+		{"POST", "/users/jane?sort=name", "application/json", "key", `{"name": "jane"}`, 400, "id"},
+		{"POST", "/users/1", "application/json", "key", `{"name": "jane"}`, 400, "sort"},
+		{"POST", "/users/1?sort=name&page=first", "application/json", "key", `{"name": "jane"}`, 400, "page"},
+		{"POST", "/users/1?sort=name", "application/json", "key", `{"name":`, 400, ""},
+		{"POST", "/users/1?sort=name", "application/json", "key", `{"name": 1}`, 422, "name"},
+		{"POST", "/users/1?sort=name", "application/json", "key", `{"name": "` + strings.Repeat("a", 64) + `"}`, 413, ""},
+		{"GET", "/posts", "", "", "", 200, ""},
+		{"DELETE", "/posts/1", "", "", "", 200, ""},
+		{"PUT", "/posts/1", "", "", "", 400, ""},
+	} {
+		req := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		req.Header.Set("Content-Type", test.contentType)
+		if test.apiKey != "" {
+			req.Header.Set("X-Api-Key", test.apiKey)
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		resp := w.Result()
+		if resp.StatusCode != test.status {
+			t.Errorf("%s %s expected response status to be %d, got %d", test.method, test.path, test.status, resp.StatusCode)
+			continue
+		}
+
+		if test.status == 200 {
+			b, _ := ioutil.ReadAll(resp.Body)
+			if string(b) != test.body {
+				t.Errorf("%s %s expected response body to be %#v, got %#v", test.method, test.path, test.body, string(b))
+			}
+			continue
+		}
+
+		if resp.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s %s expected Content-Type header to equal %s, got %s", test.method, test.path, "application/json", resp.Header.Get("Content-Type"))
+		}
+
+		verr := switchboard.ValidationError{}
+		err := json.NewDecoder(resp.Body).Decode(&verr)
+		if err != nil {
+			t.Fatalf("Decode returned an error: %s", err)
+		}
+		if verr.Status != test.status {
+			t.Errorf("%s %s expected error status to be %d, got %d", test.method, test.path, test.status, verr.Status)
+		}
+		if test.field != "" && (len(verr.Errors) != 1 || verr.Errors[0].Field != test.field) {
+			t.Errorf("%s %s expected an error for %s, got %v", test.method, test.path, test.field, verr.Errors)
+		}
+	}
+}
+
+func TestResponseHeaderTags(t *testing.T) {
+	router := newTestRouter(t, `
+routes:
+	"/api":
+		type: group
+		command:
+			inline: |
+				echo "HTTP_HEADER_X_FRAME_OPTIONS: DENY"
+				echo "HTTP_HEADER_CACHE_CONTROL: no-store"
+				echo
+		routes:
+			"/hello":
+				command:
+					inline: |
+						echo "HTTP_UNSET_HEADER: X-Frame-Options"
+						echo "HTTP_HEADER_VARY: Accept"
+						echo "HTTP_HEADER_VARY: Accept-Encoding"
+						echo "HTTP_HEADER_X_B3_TRACEID: 1"
+						echo "HTTP_HEADER_CONNECTION: close"
+						echo "HTTP_HEADER_SET_COOKIE: session=1"
+						echo "HTTP_HEADER_CONTENT_TYPE: text/html"
+						echo "HTTP_CONTENT_TYPE: text/plain"
+						echo "HTTP_ETAG: v2"
+						echo 'HTTP_HEADER_ETAG: "v1"'
+						echo
+						echo hello`)
+
+	runRouteTests(t, router, []routeTest{
+		{url: "/api/hello", status: 200, expectedHeaders: map[string]string{
+			"Cache-Control":   "no-store",
+			"Vary":            "Accept, Accept-Encoding",
+			"X-B3-Traceid":    "1",
+			"X-Frame-Options": "",
+			"Connection":      "",
+			"Set-Cookie":      "",
+			"Content-Type":    "text/plain",
+			"Etag":            `"v2"`,
+		}},
+	})
+}
+
+func TestCookies(t *testing.T) {
+	router := newTestRouter(t, `
+routes:
+	"/session":
+		before:
+			- inline: |
+					echo "HTTP_SET_COOKIE: seen=1; Max-Age=0"
+					echo
+		command:
+			inline: |
+				echo "HTTP_SET_COOKIE: session=$HTTP_COOKIE_SESSION_ID; Path=/; Max-Age=3600; Secure; HttpOnly; SameSite=Lax"
+				echo
+	"/invalid":
+		command:
+			inline: |
+				echo "HTTP_SET_COOKIE: session=abc; Color=blue"
+				echo`)
+
+	runRouteTests(t, router, []routeTest{
+		{url: "/session", headers: map[string]string{"Cookie": "session-id=abc123; session-id=other"}, status: 200, expectedHeaders: map[string]string{
+			"Set-Cookie": "seen=1; Max-Age=0, session=abc123; Path=/; Max-Age=3600; HttpOnly; Secure; SameSite=Lax",
+		}},
+		{url: "/invalid", status: 500, expectedHeaders: map[string]string{"Set-Cookie": ""}},
+	})
+}
+
+func TestRedirects(t *testing.T) {
+	router := newTestRouter(t, `
+routes:
+	"/app/account/relative":
+		command:
+			inline: |
+				echo "HTTP_REDIRECT: ../login"
+				echo
+	"/app/account/status":
+		command:
+			inline: |
+				echo "HTTP_REDIRECT: /new"
+				echo "HTTP_REDIRECT_STATUS: 308"
+				echo
+	"/app/account/absolute":
+		command:
+			inline: |
+				echo "HTTP_REDIRECT: https://example.com"
+				echo "HTTP_STATUS_CODE: 301"
+				echo
+				echo "moved"
+	"/app/account/not-redirect-status":
+		command:
+			inline: |
+				echo "HTTP_REDIRECT: /new"
+				echo "HTTP_STATUS_CODE: 200"
+				echo
+	"/app/account/invalid-status":
+		command:
+			inline: |
+				echo "HTTP_REDIRECT: /new"
+				echo "HTTP_REDIRECT_STATUS: 200"
+				echo
+	"/app/account/missing-redirect":
+		command:
+			inline: |
+				echo "HTTP_REDIRECT_STATUS: 301"
+				echo`)
+
+	runRouteTests(t, router, []routeTest{
+		{url: "/app/account/relative", status: 303, expected: "<a href=\"/app/login\">See Other</a>.\n", expectedHeaders: map[string]string{"Location": "/app/login"}},
+		{url: "/app/account/status", status: 308, expected: "<a href=\"/new\">Permanent Redirect</a>.\n", expectedHeaders: map[string]string{"Location": "/new"}},
+		{url: "/app/account/absolute", status: 301, expected: "moved\n", expectedHeaders: map[string]string{"Location": "https://example.com"}},
+		{url: "/app/account/not-redirect-status", status: 303, expectedHeaders: map[string]string{"Location": "/new"}},
+		{url: "/app/account/invalid-status", status: 500, expectedHeaders: map[string]string{"Location": ""}},
+		{url: "/app/account/missing-redirect", status: 500, expectedHeaders: map[string]string{"Location": ""}},
+	})
+}
+
+func TestJSONOutput(t *testing.T) {
+	router := newTestRouter(t, `
+routes:
+	"/api":
+		type: group
+		command:
+			output: json
+			inline: |
+				echo '{"env": {"USER_ID": "1", "QUERY": "a=b"}, "cookies": [{"name": "seen", "value": "1", "http_only": true}]}'
+		routes:
+			"/user":
+				command:
+					output: json
+					inline: |
+						echo "{\"status\": 201, \"headers\": {\"Vary\": [\"Accept\", \"Cookie\"]}, \"body\": {\"id\": $USER_ID, \"query\": \"$QUERY\"}}"
+			"/image":
+				command:
+					output: json
+					inline: |
+						echo '{"headers": {"Content-Type": "image/gif"}, "body_base64": "R0lGODlhAQABAAAAACw="}'
+			"/malformed":
+				command:
+					output: json
+					inline: |
+						echo '{"status": "ok"}'
+			"/out-of-range":
+				command:
+					output: json
+					inline: |
+						echo '{"status": 0}'
+	"/out-of-range":
+		command:
+			inline: |
+				echo "HTTP_STATUS_CODE: 1000"
+				echo`)
+
+	runRouteTests(t, router, []routeTest{
+		{url: "/api/user", status: 201, expected: `{"id": 1, "query": "a=b"}`, expectedHeaders: map[string]string{
+			"Content-Type": "application/json",
+			"Set-Cookie":   "seen=1; HttpOnly",
+		}},
+		{url: "/api/image", status: 200, expected: "GIF89a\x01\x00\x01\x00\x00\x00\x00,", expectedHeaders: map[string]string{
+			"Content-Type": "image/gif",
+			"Set-Cookie":   "seen=1; HttpOnly",
+		}},
+		{url: "/api/malformed", status: 502},
+		{url: "/api/out-of-range", status: 502},
+		{url: "/out-of-range", status: 500},
+	})
+}
+
+func TestJSONInput(t *testing.T) {
+	router := newTestRouter(t, `
+routes:
+	"/users/{id}":
+		method: POST
+		command:
+			input: json
+			inline: cat`)
+
+	for _, test := range []struct {
+		body      string
+		text      string
+		base64    string
+		hasBase64 bool
+	}{
+		{`{"name": "jane"}`, `{"name": "jane"}`, "", false},
+		{"\xff\xfe", "", "//4=", true},
+	} {
+		req := httptest.NewRequest("POST", "/users/1?tag=a&tag=b", strings.NewReader(test.body))
+		req.Header.Add("Accept", "text/plain")
+		req.Header.Add("Accept", "application/json")
+		req.Header.Set("Cookie", "session=abc")
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		envelope := switchboard.InputEnvelope{}
+		err := json.NewDecoder(w.Result().Body).Decode(&envelope)
+		if err != nil {
+			t.Fatalf("Decode returned an error: %s", err)
+		}
+
+		if envelope.Method != "POST" || envelope.Path != "/users/1" || envelope.Params["id"] != "1" {
+			t.Errorf("expected envelope to describe POST /users/1, got %#v", envelope)
+		}
+		if strings.Join(envelope.Headers["Accept"], ", ") != "text/plain, application/json" {
+			t.Errorf("expected Accept header values to be kept, got %v", envelope.Headers["Accept"])
+		}
+		if strings.Join(envelope.Query["tag"], ", ") != "a, b" {
+			t.Errorf("expected tag query values to be kept, got %v", envelope.Query["tag"])
+		}
+		if envelope.Cookies["session"] != "abc" {
+			t.Errorf("expected session cookie to equal abc, got %v", envelope.Cookies)
+		}
+		if envelope.RemoteAddr == "" {
+			t.Errorf("expected remote address to be set")
+		}
+
+		if test.hasBase64 {
+			if envelope.BodyBase64 == nil || *envelope.BodyBase64 != test.base64 {
+				t.Errorf("expected body_base64 to equal %#v, got %v", test.base64, envelope.BodyBase64)
+			}
+		} else if envelope.Body == nil || *envelope.Body != test.text {
+			t.Errorf("expected body to equal %#v, got %v", test.text, envelope.Body)
+		}
+	}
+}
+
+func TestStructuredLogging(t *testing.T) {
+	router := newTestRouter(t, `
+routes:
+	"/log":
+		command:
+			inline: |
+				echo "warming up" >&2
+				echo "LOG_FIELDS: user_id=1 action=\"sign in\""
+				echo "LOG_INFO: signed in"
+				echo "LOG_ERROR: session store unavailable"
+				echo
+				echo "$HTTP_REQUEST_ID"`)
+
+	// Setting the default structured logger also redirects the log package
+	var logs bytes.Buffer
+	defer log.SetFlags(log.Flags())
+	defer log.SetOutput(log.Writer())
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	req := httptest.NewRequest("GET", "/log", nil)
+	req.Header.Set("X-Request-Id", "abc123")
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	resp := w.Result()
+	if resp.Header.Get("X-Request-Id") != "abc123" {
+		t.Errorf("expected X-Request-Id header to equal abc123, got %s", resp.Header.Get("X-Request-Id"))
+	}
+
+	b, _ := ioutil.ReadAll(resp.Body)
+	if string(b) != "abc123\n" {
+		t.Errorf("expected response body to be %#v, got %#v", "abc123\n", string(b))
+	}
+
+	for _, expected := range []string{
+		`level=INFO msg="warming up" request_id=abc123 route=/log command=log stream=stderr`,
+		`level=INFO msg="signed in" request_id=abc123 route=/log command=log user_id=1 action="sign in"`,
+		`level=ERROR msg="session store unavailable" request_id=abc123 route=/log command=log user_id=1 action="sign in"`,
+	} {
+		if !strings.Contains(logs.String(), expected) {
+			t.Errorf("expected logs to contain %#v, got %s", expected, logs.String())
+		}
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	router := newTestRouter(t, `
+routes:
+	"/articles":
+		cache:
+			ttl: 60s
+			query: [page]
+		command:
+			inline: |
+				echo
+				date +%s%N
+	"/articles/purge":
+		method: POST
+		command:
+			inline: |
+				echo "CACHE_PURGE: /articles*"
+				echo
+	"/tagged":
+		command:
+			inline: |
+				echo "CACHE_TTL: 60"
+				echo "CACHE_KEY: /articles/tagged"
+				echo
+				date +%s%N
+	"/bypass":
+		cache:
+			ttl: 60s
+		command:
+			inline: |
+				echo "CACHE_BYPASS: true"
+				echo
+				date +%s%N
+	"/cookie":
+		cache:
+			ttl: 60s
+		command:
+			inline: |
+				echo "HTTP_SET_COOKIE: session=abc"
+				echo
+				date +%s%N
+	"/uncached":
+		command:
+			inline: |
+				echo
+				date +%s%N`)
+
+	bodies := make(map[string]string)
+	for i, test := range []struct {
+		method string
+		path   string
+		cache  string
+	}{
+		{"GET", "/articles?page=1&ref=a", "MISS"},
+		{"GET", "/articles?page=1&ref=b", "HIT"},
+		{"GET", "/articles?page=2", "MISS"},
+		{"GET", "/tagged", "MISS"},
+		{"GET", "/tagged", "HIT"},
+		{"GET", "/bypass", ""},
+		{"GET", "/bypass", ""},
+		{"GET", "/cookie", ""},
+		{"GET", "/cookie", ""},
+		{"GET", "/uncached", ""},
+		{"GET", "/uncached", ""},
+		{"POST", "/articles/purge", ""},
+		{"GET", "/articles?page=1", "MISS"},
+		{"GET", "/tagged", "MISS"},
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(test.method, test.path, nil))
+
+		resp := w.Result()
+		if resp.StatusCode != 200 {
+			t.Errorf("%d: %s %s expected response status to be 200, got %d", i, test.method, test.path, resp.StatusCode)
+		}
+		if resp.Header.Get("X-Cache") != test.cache {
+			t.Errorf("%d: %s %s expected X-Cache header to equal %#v, got %#v", i, test.method, test.path, test.cache, resp.Header.Get("X-Cache"))
+		}
+		if test.cache == "HIT" && resp.Header.Get("Age") == "" {
+			t.Errorf("%d: %s %s expected an Age header", i, test.method, test.path)
+		}
+		if test.cache != "" && resp.Header.Get("Cache-Control") != "max-age=60" {
+			t.Errorf("%d: %s %s expected Cache-Control header to equal max-age=60, got %#v", i, test.method, test.path, resp.Header.Get("Cache-Control"))
+		}
+
+		b, _ := ioutil.ReadAll(resp.Body)
+		key := strings.SplitN(test.path, "?", 2)[0]
+		if test.cache == "HIT" && string(b) != bodies[key] {
+			t.Errorf("%d: %s %s expected cached body %#v, got %#v", i, test.method, test.path, bodies[key], string(b))
+		} else if test.cache != "HIT" && test.method == "GET" && string(b) == bodies[key] {
+			t.Errorf("%d: %s %s expected a new body, got %#v", i, test.method, test.path, string(b))
+		}
+		bodies[key] = string(b)
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	router := newTestRouter(t, `
+routes:
+	"/tagged":
+		command:
+			inline: |
+				echo "HTTP_ETAG: abc"
+				echo "HTTP_LAST_MODIFIED: Mon, 02 Jan 2006 15:04:05 GMT"
+				echo
+				echo "hello"
+	"/auto":
+		etag: auto
+		command:
+			inline: |
+				echo "hello"
+	"/update":
+		method: PUT
+		command:
+			inline: |
+				echo "HTTP_ETAG: W/\"v2\""
+				echo
+				echo "updated"
+	"/items":
+		method: [PUT, DELETE]
+		before:
+			- inline: |
+					echo "HTTP_ETAG: v1"
+					echo
+		command:
+			inline: |
+				echo "HTTP_ETAG: v2"
+				echo
+				echo "updated"
+	"/invalid":
+		command:
+			inline: |
+				echo "HTTP_ETAG: a\"b"
+				echo`)
+
+	auto := switchboard.ETagFromBody([]byte("hello\n"))
+	for _, test := range []struct {
+		method string
+		path   string
+		header string
+		value  string
+		status int
+		etag   string
+		body   string
+	}{
+		{"GET", "/tagged", "", "", 200, `"abc"`, "hello\n"},
+		{"GET", "/tagged", "If-None-Match", `"abc"`, 304, `"abc"`, ""},
+		{"GET", "/tagged", "If-None-Match", `"xyz", W/"abc"`, 304, `"abc"`, ""},
+		{"GET", "/tagged", "If-None-Match", `"xyz"`, 200, `"abc"`, "hello\n"},
+		{"GET", "/tagged", "If-Modified-Since", "Mon, 02 Jan 2006 15:04:05 GMT", 304, `"abc"`, ""},
+		{"GET", "/tagged", "If-Modified-Since", "Sun, 01 Jan 2006 15:04:05 GMT", 200, `"abc"`, "hello\n"},
+		{"GET", "/tagged", "If-Match", `"xyz"`, 412, `"abc"`, ""},
+		{"GET", "/tagged", "If-Unmodified-Since", "Sun, 01 Jan 2006 15:04:05 GMT", 412, `"abc"`, ""},
+		{"GET", "/auto", "", "", 200, auto, "hello\n"},
+		{"GET", "/auto", "If-None-Match", auto, 304, auto, ""},
+		{"PUT", "/update", "If-Match", `"v1"`, 200, `W/"v2"`, "updated\n"},
+		{"PUT", "/update", "If-None-Match", "*", 200, `W/"v2"`, "updated\n"},
+		{"PUT", "/items", "If-Match", `"v1"`, 200, `"v2"`, "updated\n"},
+		{"PUT", "/items", "If-Match", `"v0"`, 412, `"v1"`, ""},
+		{"DELETE", "/items", "If-Unmodified-Since", "Sun, 01 Jan 2006 15:04:05 GMT", 200, `"v2"`, "updated\n"},
+		{"PUT", "/items", "If-None-Match", "*", 412, `"v1"`, ""},
+		{"PUT", "/items", "If-None-Match", `"v0"`, 200, `"v2"`, "updated\n"},
+		{"GET", "/invalid", "", "", 500, "", ""},
+	} {
+		r := httptest.NewRequest(test.method, test.path, nil)
+		if test.header != "" {
+			r.Header.Set(test.header, test.value)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		resp := w.Result()
+		if resp.StatusCode != test.status {
+			t.Errorf("%s %s with %s expected response status to be %d, got %d", test.method, test.path, test.header, test.status, resp.StatusCode)
+		}
+		if resp.Header.Get("ETag") != test.etag {
+			t.Errorf("%s %s with %s expected ETag header to equal %s, got %s", test.method, test.path, test.header, test.etag, resp.Header.Get("ETag"))
+		}
+
+		b, _ := ioutil.ReadAll(resp.Body)
+		if test.status != 500 && string(b) != test.body {
+			t.Errorf("%s %s with %s expected response body to be %#v, got %#v", test.method, test.path, test.header, test.body, string(b))
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	router := newTestRouter(t, `
+compression:
+	min_size: 32
+	max_body_size: 64
+error:
+	inline: echo "$ERROR_STATUS $ERROR_MESSAGE"
+routes:
+	"/text":
+		command:
+			inline: |
+				echo "HTTP_CONTENT_TYPE: text/plain; charset=utf-8"
+				echo
+				echo "hello world hello world hello world hello world"
+	"/small":
+		command:
+			inline: |
+				echo "HTTP_CONTENT_TYPE: text/plain"
+				echo
+				echo "hello"
+	"/binary":
+		command:
+			inline: |
+				echo "HTTP_CONTENT_TYPE: image/png"
+				echo
+				echo "hello world hello world hello world hello world"
+	"/opt-out":
+		command:
+			inline: |
+				echo "HTTP_CONTENT_TYPE: text/plain"
+				echo "HTTP_COMPRESS: false"
+				echo
+				echo "hello world hello world hello world hello world"
+	"/encoded":
+		command:
+			inline: |
+				echo "HTTP_CONTENT_TYPE: text/plain"
+				echo "HTTP_HEADER_CONTENT_ENCODING: identity"
+				echo
+				echo "hello world hello world hello world hello world"
+	"/echo":
+		method: POST
+		command:
+			inline: |
+				echo "HTTP_COMPRESS: false"
+				echo
+				cat`)
+
+	long := "hello world hello world hello world hello world\n"
+	for _, test := range []struct {
+		path           string
+		acceptEncoding string
+		encoding       string
+		body           string
+	}{
+		{"/text", "gzip", "gzip", long},
+		{"/text", "deflate", "deflate", long},
+		{"/text", "br", "br", long},
+		{"/text", "br;q=0.5, gzip;q=0.8", "gzip", long},
+		{"/text", "*", "br", long},
+		{"/text", "gzip;q=0", "", long},
+		{"/text", "", "", long},
+		{"/small", "gzip", "", "hello\n"},
+		{"/binary", "gzip", "", long},
+		{"/opt-out", "gzip", "", long},
+		{"/encoded", "gzip", "identity", long},
+	} {
+		r := httptest.NewRequest("GET", test.path, nil)
+		r.Header.Set("Accept-Encoding", test.acceptEncoding)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		resp := w.Result()
+		encoding := resp.Header.Get("Content-Encoding")
+		if encoding != test.encoding {
+			t.Errorf("GET %s with %#v expected Content-Encoding to equal %#v, got %#v", test.path, test.acceptEncoding, test.encoding, encoding)
+			continue
+		}
+
+		var reader io.Reader = resp.Body
+		var err error
+		switch encoding {
+		case "gzip":
+			reader, err = gzip.NewReader(resp.Body)
+		case "deflate":
+			reader, err = zlib.NewReader(resp.Body)
+		case "br":
+			reader = brotli.NewReader(resp.Body)
+		}
+		if err != nil {
+			t.Fatalf("GET %s with %#v returned a malformed body: %s", test.path, test.acceptEncoding, err)
+		}
+
+		b, _ := ioutil.ReadAll(reader)
+		if string(b) != test.body {
+			t.Errorf("GET %s with %#v expected response body to be %#v, got %#v", test.path, test.acceptEncoding, test.body, string(b))
+		}
+	}
+
+	var compressed bytes.Buffer
+	gw := gzip.NewWriter(&compressed)
+	gw.Write([]byte(long))
+	gw.Close()
+
+	r := httptest.NewRequest("POST", "/echo", &compressed)
+	r.Header.Set("Content-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	if w.Body.String() != long {
+		t.Errorf("POST /echo expected the request body to be decoded, got %#v", w.Body.String())
+	}
+
+	r = httptest.NewRequest("POST", "/echo", strings.NewReader(long))
+	r.Header.Set("Content-Encoding", "compress")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	if w.Code != 415 || w.Body.String() != "415 unsupported Content-Encoding\n" {
+		t.Errorf("POST /echo with an unsupported Content-Encoding expected the error handler to respond with 415, got %d %#v", w.Code, w.Body.String())
+	}
+
+	compressed.Reset()
+	gw = gzip.NewWriter(&compressed)
+	gw.Write([]byte(strings.Repeat(long, 2)))
+	gw.Close()
+
+	r = httptest.NewRequest("POST", "/echo", &compressed)
+	r.Header.Set("Content-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	if w.Code != 413 || w.Body.String() != "413 request body too large\n" {
+		t.Errorf("POST /echo with a body larger than max_body_size expected the error handler to respond with 413, got %d %#v", w.Code, w.Body.String())
+	}
+}
+
+func TestResponseCacheWithAuth(t *testing.T) {
+	router := newTestRouter(t, `
+routes:
+	"/me":
+		cache:
+			ttl: 60s
+		auth:
+			inline: |
+				case "$HTTP_HEADER_AUTHORIZATION" in
+					alice) echo "ENV_SET: USER_NAME=alice" ;;
+					bob) echo "ENV_SET: USER_NAME=bob" ;;
+					*)
+						echo "HALT: true"
+						echo "HTTP_STATUS_CODE: 401"
+						;;
+				esac
+				echo
+		command:
+			inline: |
+				echo "$USER_NAME $(date +%s%N)"`)
+
+	bodies := make(map[string]string)
+	for i, test := range []struct {
+		token  string
+		status int
+		cache  string
+	}{
+		{"alice", 200, "MISS"},
+		{"", 401, ""},
+		{"mallory", 401, ""},
+		{"alice", 200, "HIT"},
+		{"bob", 200, "MISS"},
+		{"bob", 200, "HIT"},
+	} {
+		r := httptest.NewRequest("GET", "/me", nil)
+		if test.token != "" {
+			r.Header.Set("Authorization", test.token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		if w.Code != test.status {
+			t.Errorf("%d: token %#v expected response status to be %d, got %d", i, test.token, test.status, w.Code)
+		}
+		if w.Header().Get("X-Cache") != test.cache {
+			t.Errorf("%d: token %#v expected X-Cache header to equal %#v, got %#v", i, test.token, test.cache, w.Header().Get("X-Cache"))
+		}
+		if test.status != 200 {
+			continue
+		}
+
+		if !strings.HasPrefix(w.Body.String(), test.token+" ") {
+			t.Errorf("%d: token %#v got the response of another user %#v", i, test.token, w.Body.String())
+		}
+		if test.cache == "HIT" && w.Body.String() != bodies[test.token] {
+			t.Errorf("%d: token %#v expected cached body %#v, got %#v", i, test.token, bodies[test.token], w.Body.String())
+		}
+		bodies[test.token] = w.Body.String()
+	}
+}
+
+func TestResponseCacheDir(t *testing.T) {
+	router := newTestRouter(t, fmt.Sprintf(`
+cache:
+	dir: %s
+routes:
+	"/articles":
+		cache:
+			ttl: 60s
+		command:
+			inline: |
+				date +%%s%%N`, t.TempDir()))
+
+	previous := ""
+	for i, test := range []struct {
+		noCache bool
+		cache   string
+	}{
+		{false, "MISS"},
+		{false, "HIT"},
+		{true, "MISS"},
+		{false, "HIT"},
+	} {
+		r := httptest.NewRequest("GET", "/articles", nil)
+		if test.noCache {
+			r.Header.Set("Cache-Control", "no-cache")
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		if w.Header().Get("X-Cache") != test.cache {
+			t.Errorf("%d: expected X-Cache header to equal %#v, got %#v", i, test.cache, w.Header().Get("X-Cache"))
+		}
+		if test.cache == "HIT" && w.Body.String() != previous {
+			t.Errorf("%d: expected cached body %#v, got %#v", i, previous, w.Body.String())
+		}
+		previous = w.Body.String()
+	}
+}
+
+func TestResponseCacheReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	body := strings.Replace(`
+routes:
+	"/articles":
+		cache:
+			ttl: 60s
+		command:
+			inline: |
+				date +%s%N`, "\t", "  ", -1)
+	if err := ioutil.WriteFile(path, []byte(body), 0600); err != nil {
+		t.Fatalf("ioutil.WriteFile returned an error: %s", err)
+	}
+
+	router, err := switchboard.BuildReloadRouter(path)
+	if err != nil {
+		t.Fatalf("BuildReloadRouter returned an error: %s", err)
+	}
+
+	previous := ""
+	for i, cache := range []string{"MISS", "HIT"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/articles", nil))
+
+		if w.Header().Get("X-Cache") != cache {
+			t.Errorf("%d: expected X-Cache header to equal %#v, got %#v", i, cache, w.Header().Get("X-Cache"))
+		}
+		if cache == "HIT" && w.Body.String() != previous {
+			t.Errorf("%d: expected cached body %#v, got %#v", i, previous, w.Body.String())
+		}
+		previous = w.Body.String()
+	}
+}
+
+func TestMultipartForms(t *testing.T) {
+	router := newTestRouter(t, `
+routes:
+	"/upload":
+		method: POST
+		form:
+			multipart: true
+			max_size: 2048
+			max_files: 2
+		command:
+			inline: |
+				echo "$HTTP_FORM_TITLE"
+				echo "$HTTP_FILE_UPLOAD_NAME $HTTP_FILE_UPLOAD_TYPE $HTTP_FILE_UPLOAD_SIZE $HTTP_FILE_UPLOAD_COUNT"
+				echo "$HTTP_FILE_UPLOAD_1_NAME"
+				cat "$HTTP_FILE_UPLOAD_PATH"
+				echo
+				echo "$HTTP_FILE_UPLOAD_PATH"`)
+
+	for _, test := range []struct {
+		name   string
+		fields map[string]string
+		files  []string
+		size   int
+		status int
+		body   string
+	}{
+		{"single file", map[string]string{"title": "report", "ignored": "x"}, []string{"a.txt"}, 5, 200, "report\na.txt text/plain 5 1\n\naaaaa\n"},
+		{"two files", map[string]string{"title": "report"}, []string{"../a.txt", "b.txt"}, 3, 200, "report\na.txt text/plain 3 2\nb.txt\naaa\n"},
+		{"too many files", nil, []string{"a.txt", "b.txt", "c.txt"}, 1, 413, ""},
+		{"too large", nil, []string{"a.txt"}, 4096, 413, ""},
+	} {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		for name, value := range test.fields {
+			mw.WriteField(name, value)
+		}
+		for _, name := range test.files {
+			header := make(textproto.MIMEHeader)
+			header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="upload"; filename="%s"`, name))
+			header.Set("Content-Type", "text/plain")
+			part, _ := mw.CreatePart(header)
+			part.Write(bytes.Repeat([]byte("a"), test.size))
+		}
+		mw.Close()
+
+		r := httptest.NewRequest("POST", "/upload", &buf)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		if w.Code != test.status {
+			t.Errorf("%s expected response status to be %d, got %d", test.name, test.status, w.Code)
+			continue
+		}
+		if test.status != 200 {
+			continue
+		}
+
+		lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+		path := lines[len(lines)-1]
+		output := strings.Join(lines[:len(lines)-1], "\n") + "\n"
+		if output != test.body {
+			t.Errorf("%s expected response body to be %#v, got %#v", test.name, test.body, output)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s expected upload %s to be removed", test.name, path)
+		}
+	}
+
+	r := httptest.NewRequest("POST", "/upload", strings.NewReader("--x\r\nbroken"))
+	r.Header.Set("Content-Type", "multipart/form-data; boundary=x")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	if w.Code != 400 {
+		t.Errorf("malformed body expected response status to be 400, got %d", w.Code)
+	}
+}
+
+func TestQueryAndFormValues(t *testing.T) {
+	router := newTestRouter(t, `
+routes:
+	"/search":
+		method: [GET, POST]
+		form:
+			urlencoded: true
+			max_size: 64
+		command:
+			inline: |
+				env | grep -E '^HTTP_(QUERY|FORM)_' | sort
+				cat`)
+
+	form := map[string]string{"Content-Type": "application/x-www-form-urlencoded"}
+	runRouteTests(t, router, []routeTest{
+		{method: "GET", url: "/search?q=go&tag=a&tag=b", status: 200, expected: strings.Join([]string{
+			"HTTP_QUERY_Q=go",
+			"HTTP_QUERY_Q_0=go",
+			"HTTP_QUERY_Q_COUNT=1",
+			"HTTP_QUERY_TAG=a,b",
+			"HTTP_QUERY_TAG_0=a",
+			"HTTP_QUERY_TAG_1=b",
+			"HTTP_QUERY_TAG_COUNT=2",
+			"",
+		}, "\n")},
+		{method: "GET", url: "/search?user-id=1&user_id=2&a=x&a_0=y&%21=z", status: 200, expected: strings.Join([]string{
+			"HTTP_QUERY_A=x",
+			"HTTP_QUERY_A_0=y",
+			"HTTP_QUERY_A_0_0=y",
+			"HTTP_QUERY_A_0_COUNT=1",
+			"HTTP_QUERY_A_COUNT=1",
+			"HTTP_QUERY_USER_ID=1,2",
+			"HTTP_QUERY_USER_ID_0=1",
+			"HTTP_QUERY_USER_ID_1=2",
+			"HTTP_QUERY_USER_ID_COUNT=2",
+			"HTTP_QUERY__=z",
+			"HTTP_QUERY___0=z",
+			"HTTP_QUERY___COUNT=1",
+			"",
+		}, "\n")},
+		{method: "POST", url: "/search", headers: form, body: "name=Ada+Lovelace", status: 200, expected: strings.Join([]string{
+			"HTTP_FORM_NAME=Ada Lovelace",
+			"HTTP_FORM_NAME_0=Ada Lovelace",
+			"HTTP_FORM_NAME_COUNT=1",
+			"name=Ada+Lovelace",
+		}, "\n")},
+		{method: "POST", url: "/search", headers: map[string]string{"Content-Type": "text/plain"}, body: "name=Ada", status: 200, expected: "name=Ada"},
+		{method: "POST", url: "/search", headers: form, body: "name=%zz", status: 400},
+		{method: "POST", url: "/search", headers: form, body: strings.Repeat("a", 65), status: 413},
+	})
+}
@@ -16,14 +16,22 @@ func NewServer(path string, port int, reload bool) (*http.Server, error) {
 		return nil, fmt.Errorf("error reading config: %s", err)
 	}
 
-	var router http.Handler
-	if !reload {
-		router, err = BuildRouter(config)
-		if err != nil {
-			return nil, fmt.Errorf("error building routes: %s", err)
-		}
-	} else {
-		router, err = BuildReloadRouter(path)
+	router, err := NewRouter(config, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error building routes: %s", err)
+	}
+
+	conflicts, err := DetectConflicts(router)
+	if err != nil {
+		return nil, fmt.Errorf("error checking routes: %s", err)
+	}
+	for _, conflict := range conflicts {
+		log.Printf("warning: %s", conflict)
+	}
+
+	var handler http.Handler = router
+	if reload {
+		handler, err = BuildReloadRouter(path)
 		if err != nil {
 			return nil, fmt.Errorf("error building routes: %s", err)
 		}
@@ -31,28 +39,99 @@ func NewServer(path string, port int, reload bool) (*http.Server, error) {
 
 	return &http.Server{
 		Addr:    fmt.Sprintf(":%d", port),
-		Handler: router,
+		Handler: handler,
 	}, nil
 }
 
 func BuildRouter(config *Config) (http.Handler, error) {
+	return NewRouter(config, nil)
+}
+
+// NewRouter builds the router for the config. A cache is created from the
+// config when none is given.
+func NewRouter(config *Config, cache *Cache) (*mux.Router, error) {
+	var err error
+	if cache == nil {
+		cache, err = NewCache(config.Cache)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	router := mux.NewRouter()
+
+	// The document is served before the config routes so a catch-all route
+	// cannot hide it, it is built once they are attached
+	var openapi *mux.Route
+	if config.OpenAPI.Path != "" {
+		log.Printf("routing to GET %s", config.OpenAPI.Path)
+		openapi = router.NewRoute().Path(config.OpenAPI.Path).Methods("GET")
+	}
+
 	route := &RootRoute{Routes: config.Routes}
-	err := route.AttachHandlers(router, Pipeline{})
+	err = route.AttachHandlers(router, Pipeline{})
 	if err != nil {
 		return nil, err
 	}
+
+	if openapi != nil {
+		document, err := NewOpenAPIDocument(router, config.OpenAPI)
+		if err != nil {
+			return nil, err
+		}
+
+		handler, err := OpenAPIHandler(document)
+		if err != nil {
+			return nil, err
+		}
+		openapi.Handler(handler)
+	}
+
+	router.NotFoundHandler = config.ErrorHandlers.NotFoundHandler()
+	router.MethodNotAllowedHandler = config.ErrorHandlers.MethodNotAllowedHandler(router)
+	router.Use(RequestIDMiddleware, config.ErrorHandlers.Middleware, CompressionMiddleware(config.Compression), cache.Middleware, RouterMiddleware(router))
 	return router, nil
 }
 
+// AllowedMethods returns the methods routed for the request's path
+func AllowedMethods(router *mux.Router, r *http.Request) []string {
+	candidates := []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+	endpoints, _ := Endpoints(router)
+	for _, endpoint := range endpoints {
+		for _, method := range endpoint.Methods {
+			if !containsMethod(candidates, method) {
+				candidates = append(candidates, method)
+			}
+		}
+	}
+
+	var allowed []string
+	for _, method := range candidates {
+		req := r.WithContext(r.Context())
+		req.Method = method
+
+		var match mux.RouteMatch
+		if router.Match(req, &match) && match.MatchErr == nil {
+			allowed = append(allowed, method)
+		}
+	}
+	return allowed
+}
+
 func BuildReloadRouter(path string) (http.Handler, error) {
 	log.Printf("watching config at path %s", path)
 
-	_, err := ReadConfig(path)
+	config, err := ReadConfig(path)
 	if err != nil {
 		return nil, fmt.Errorf("error reading config: %s", err)
 	}
 
+	// The cache outlives the routers, changes to its config need a restart
+	cache, err := NewCache(config.Cache)
+	if err != nil {
+		return nil, err
+	}
+
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		log.Printf("reloading config at path %s", path)
 
@@ -62,7 +141,7 @@ func BuildReloadRouter(path string) (http.Handler, error) {
 			return
 		}
 
-		router, err := BuildRouter(config)
+		router, err := NewRouter(config, cache)
 		if err != nil {
 			log.Printf("error rebuilding routes: %s", err)
 			return
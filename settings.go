@@ -0,0 +1,130 @@
+package switchboard
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RouteSettings are resolved for each route when the config is read. A route
+// inherits the settings of its parent routes and may override them:
+//
+//   env
+//   Environment variables merged with the parent's
+//
+//   timeout
+//   Used by commands that do not set their own timeout
+//
+//   driver
+//   Used by inline commands that do not set their own driver
+//
+//   method
+//   Used by child routes of a group that do not set their own methods
+//
+//   auth
+//   Runs before the route and every child route, Auth lists the names of
+//   the auth commands from the outermost route inwards
+type RouteSettings struct {
+	Env     map[string]string
+	Timeout time.Duration
+	Driver  string
+	Methods []string
+	Auth    []string
+}
+
+func (settings RouteSettings) Inherit(routeYAML *RouteYAML) (RouteSettings, error) {
+	inherited := RouteSettings{
+		Env:     make(map[string]string),
+		Timeout: settings.Timeout,
+		Driver:  settings.Driver,
+		Methods: settings.Methods,
+		Auth:    settings.Auth,
+	}
+
+	for key, value := range settings.Env {
+		inherited.Env[key] = value
+	}
+	for key, value := range routeYAML.Env {
+		inherited.Env[key] = value
+	}
+
+	if routeYAML.Timeout != "" {
+		timeout, err := time.ParseDuration(routeYAML.Timeout)
+		if err != nil {
+			return inherited, fmt.Errorf("invalid timeout: %s", err)
+		}
+		inherited.Timeout = timeout
+	}
+
+	if routeYAML.Driver != "" {
+		inherited.Driver = routeYAML.Driver
+	}
+
+	switch method := routeYAML.Method.(type) {
+	case string:
+		inherited.Methods = []string{method}
+	case []interface{}:
+		methods := make([]string, len(method))
+		for i, m := range method {
+			s, ok := m.(string)
+			if !ok {
+				return inherited, fmt.Errorf("invalid method %v", m)
+			}
+			methods[i] = s
+		}
+		inherited.Methods = methods
+	case nil:
+	default:
+		return inherited, fmt.Errorf("invalid method %v", method)
+	}
+
+	return inherited, nil
+}
+
+// Apply returns the command with the settings applied. Commands are shared
+// between routes so a copy is returned if the command needs to change.
+func (settings RouteSettings) Apply(command *Command) *Command {
+	if command == nil || command.Timeout != 0 || settings.Timeout == 0 {
+		return command
+	}
+
+	c := *command
+	c.Timeout = settings.Timeout
+	return &c
+}
+
+// EnvList returns the settings' environment variables ordered by name
+func (settings RouteSettings) EnvList() []string {
+	keys := make([]string, 0, len(settings.Env))
+	for key := range settings.Env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	env := make([]string, len(keys))
+	for i, key := range keys {
+		env[i] = fmt.Sprintf("%s=%s", key, settings.Env[key])
+	}
+	return env
+}
+
+func (settings RouteSettings) String() string {
+	var lines []string
+	if len(settings.Env) > 0 {
+		lines = append(lines, fmt.Sprintf("env: %s", strings.Join(settings.EnvList(), " ")))
+	}
+	if settings.Timeout != 0 {
+		lines = append(lines, fmt.Sprintf("timeout: %s", settings.Timeout))
+	}
+	if settings.Driver != "" {
+		lines = append(lines, fmt.Sprintf("driver: %s", settings.Driver))
+	}
+	if settings.Methods != nil {
+		lines = append(lines, fmt.Sprintf("methods: %s", strings.Join(settings.Methods, ",")))
+	}
+	if len(settings.Auth) > 0 {
+		lines = append(lines, fmt.Sprintf("auth: %s", strings.Join(settings.Auth, " -> ")))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -1,8 +1,10 @@
 package switchboard
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
+	"strings"
 
 	"github.com/urfave/cli"
 )
@@ -28,6 +30,68 @@ func Routes(c *cli.Context) error {
 	if err != nil {
 		return cli.NewExitError(err.Error(), 1)
 	}
-	fmt.Printf("%#v\n", config)
+
+	router, err := NewRouter(config, nil)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	endpoints, err := Endpoints(router)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	for _, endpoint := range endpoints {
+		fmt.Printf(
+			"%-24s %-40s %s\n",
+			strings.Join(endpointMethods(endpoint), ","),
+			endpoint,
+			strings.Join(endpoint.Pipeline.Names(), " -> "),
+		)
+
+		settings := endpoint.Pipeline.Settings().String()
+		if settings != "" {
+			fmt.Printf("%25s%s\n", "", strings.Replace(settings, "\n", fmt.Sprintf("\n%25s", ""), -1))
+		}
+	}
+
+	conflicts, err := DetectConflicts(router)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	if len(conflicts) > 0 {
+		fmt.Printf("\nconflicts:\n")
+		for _, conflict := range conflicts {
+			fmt.Printf("  %s\n", conflict)
+		}
+	}
+
+	return nil
+}
+
+func OpenAPI(c *cli.Context) error {
+	path := c.GlobalString("config")
+	config, err := ReadConfig(path)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	router, err := NewRouter(config, nil)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	document, err := NewOpenAPIDocument(router, config.OpenAPI)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	b, err := json.MarshalIndent(document, "", "  ")
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	fmt.Printf("%s\n", b)
 	return nil
 }
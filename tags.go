@@ -4,15 +4,43 @@ import (
 	"bufio"
 	"bytes"
 	"errors"
+	"fmt"
+	"html"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 )
 
 type Tags map[string][]string
 
+const (
+	HeaderTagPrefix = "HTTP_HEADER_"
+)
+
+var (
+	// guardedHeaders cannot be set or unset with tags. Hop-by-hop headers only
+	// apply to a single connection, Content-Length is computed from the body
+	// and cookies are set with their own tag.
+	guardedHeaders = map[string]bool{
+		"Connection":          true,
+		"Keep-Alive":          true,
+		"Proxy-Authenticate":  true,
+		"Proxy-Authorization": true,
+		"Proxy-Connection":    true,
+		"Te":                  true,
+		"Trailer":             true,
+		"Transfer-Encoding":   true,
+		"Upgrade":             true,
+		"Content-Length":      true,
+		"Set-Cookie":          true,
+	}
+)
+
 // Tags are header-like key value pairs that are included at the beginning of
 // command output are used to control the HTTP response.
 //
@@ -32,59 +60,107 @@ type Tags map[string][]string
 //   Sets the status code
 //
 //   HTTP_REDIRECT
-//   Sets the status code to 303 and the Location header
+//   Sets the Location header and a redirect status, relative locations are
+//   resolved against the request path
+//
+//   HTTP_REDIRECT_STATUS
+//   Sets the status of a redirect to 301, 302, 303, 307 or 308. Without it
+//   a 3xx HTTP_STATUS_CODE is used, otherwise 303.
+//
+//   HTTP_HEADER_<NAME>
+//   Sets a response header, underscores in the name become dashes, e.g.
+//   HTTP_HEADER_CACHE_CONTROL sets Cache-Control. Repeat the tag to set
+//   multiple values. Hop-by-hop headers, Content-Length and Set-Cookie
+//   cannot be set. HTTP_CONTENT_TYPE, HTTP_REDIRECT, HTTP_ETAG and
+//   HTTP_LAST_MODIFIED override the header they set.
+//
+//   HTTP_UNSET_HEADER
+//   Removes a response header set by an earlier command
+//
+//   HTTP_ETAG, HTTP_LAST_MODIFIED
+//   Set the ETag and Last-Modified headers of a response. Conditional GET
+//   and HEAD requests for successful responses are answered with 304 Not
+//   Modified or 412 Precondition Failed, see CheckPreconditions. For other
+//   methods the tags of a stage before the route's command, such as a before
+//   command, describe the current version: the preconditions are checked
+//   against them and the pipeline halts with 412 Precondition Failed before
+//   the route's command runs.
+//
+//   HTTP_COMPRESS
+//   Set to false to send the response uncompressed, see CompressionConfig
+//
+//   HTTP_SET_COOKIE
+//   Sets a cookie, e.g. "session=abc123; Path=/; HttpOnly". Repeat the tag
+//   to set multiple cookies. See ParseSetCookie for the attributes.
+//
+//   ENV_SET, ENV_UNSET, ENV_APPEND
+//   Change the environment of the following commands, see ApplyEnvTags
+//
+//   FORWARD
+//   Runs the pipeline of another route with the current env, tags and body,
+//   instead of the after commands
 //
-//   DEBUG
-//   Logs to STDOUT
+//   DEBUG, LOG_INFO, LOG_WARN, LOG_ERROR, LOG_FIELDS
+//   Send messages to the structured logger, see LogTags
 //
+//   CACHE_TTL, CACHE_KEY, CACHE_BYPASS, CACHE_PURGE
+//   Control the response cache, see Cache
+//
+// The tags end at the first blank line, lines may end in LF or CRLF. Blank
+// lines before the tags are skipped. The rest of the output is returned as
+// the body without changes, so commands may write binary data. Output that
+// does not start with a tag is returned as the body in full.
 func ParseTags(stdout io.Reader) (Tags, io.Reader, error) {
 	tags := make(Tags)
-	scanner := bufio.NewScanner(stdout)
-	isHeader := true
-	var rest bytes.Buffer
+	reader := bufio.NewReader(stdout)
+	var consumed bytes.Buffer
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+		consumed.Write(line)
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		matches := isTag.FindStringSubmatch(line)
+		trimmed := strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r")
+		matches := isTag.FindStringSubmatch(trimmed)
 
-		if len(matches) > 0 {
+		switch {
+		case len(matches) > 0:
 			log.Printf("tag found %s=%s", matches[1], matches[2])
 			tags[matches[1]] = append(tags[matches[1]], matches[2])
-		} else if line == "" {
-			isHeader = false
-		} else if isHeader && len(tags) > 0 {
+		case trimmed == "" && len(tags) > 0:
+			return tags, reader, nil
+		case trimmed == "" && err == nil:
+			// Blank lines before the tags are skipped
+		case len(tags) > 0:
 			return nil, nil, errors.New("tags and output must be separated with a blank line")
-		} else if !isHeader {
-			rest.Write(append(scanner.Bytes(), byte('\n')))
-		} else {
-			rest.Write(append(scanner.Bytes(), byte('\n')))
-			isHeader = false
+		default:
+			return tags, io.MultiReader(&consumed, reader), nil
 		}
-	}
-	if err := scanner.Err(); err != nil {
-		return nil, nil, err
-	}
 
-	return tags, &rest, nil
+		if err == io.EOF {
+			return tags, reader, nil
+		}
+	}
 }
 
 func ApplyBetweenTags(routeTags Tags, tags Tags, env *[]string) (bool, error) {
 	halt := false
 
+	updated, err := ApplyEnvTags(routeTags, *env)
+	if err != nil {
+		return false, err
+	}
+	*env = updated
+
 	for key, values := range routeTags {
 		value := values[len(values)-1]
 
 		switch key {
-		case "ENV_SET":
-			envPair := strings.Split(value, "=")
-			if len(envPair) != 2 {
-				return false, errors.New("Unrecognized ENV_SET value")
-			}
-			*env = append(*env, value)
-		case "DEBUG":
-			for _, v := range values {
-				log.Printf("DEBUG: %s", v)
-			}
+		case "ENV_SET", "ENV_UNSET", "ENV_APPEND":
+		case "HTTP_UNSET_HEADER", "HTTP_SET_COOKIE", "CACHE_PURGE":
+			tags[key] = append(tags[key], values...)
 		case "HALT":
 			switch value {
 			case "true":
@@ -99,36 +175,234 @@ func ApplyBetweenTags(routeTags Tags, tags Tags, env *[]string) (bool, error) {
 		}
 	}
 
+	// Headers set by this command replace headers unset by earlier commands
+	for key := range routeTags {
+		if !strings.HasPrefix(key, HeaderTagPrefix) {
+			continue
+		}
+
+		name := HeaderName(strings.TrimPrefix(key, HeaderTagPrefix))
+		unset := tags["HTTP_UNSET_HEADER"][:0]
+		for _, value := range tags["HTTP_UNSET_HEADER"] {
+			if HeaderName(value) != name {
+				unset = append(unset, value)
+			}
+		}
+		tags["HTTP_UNSET_HEADER"] = unset
+	}
+	if len(tags["HTTP_UNSET_HEADER"]) == 0 {
+		delete(tags, "HTTP_UNSET_HEADER")
+	}
+
 	return halt, nil
 }
 
-func ApplyEndTags(tags Tags, w http.ResponseWriter) error {
-	for key, values := range tags {
-		value := values[len(values)-1]
-		switch key {
-		case "HTTP_CONTENT_TYPE":
-			log.Print("setting content-type header")
-			w.Header().Set("Content-Type", value)
-		case "HTTP_REDIRECT":
-			log.Print("redirecting to %s", value)
-			w.Header().Set("Location", value)
-			w.WriteHeader(303)
+// TagsToEnv exports tags as TAG_* environment variables, e.g.
+// TAG_HTTP_STATUS_CODE=201, so after commands can inspect and rewrite the
+// response built by earlier commands
+func TagsToEnv(tags Tags) []string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	env := make([]string, 0, len(keys))
+	for _, key := range keys {
+		env = append(env, fmt.Sprintf("TAG_%s=%s", key, strings.Join(tags[key], ", ")))
+	}
+	return env
+}
+
+// HeaderName converts a tag name such as CACHE_CONTROL, or a header name in
+// any case, to a canonical header name such as Cache-Control
+func HeaderName(name string) string {
+	return http.CanonicalHeaderKey(strings.Replace(strings.TrimSpace(name), "_", "-", -1))
+}
+
+// ApplyEndTags writes the response headers, status and body for the tags.
+// Redirects without a body respond with a short HTML page linking to the
+// new location.
+func ApplyEndTags(tags Tags, w http.ResponseWriter, r *http.Request, body io.Reader) error {
+	// Everything that can fail is checked before anything is written
+	status, err := ResponseStatus(tags)
+	if err != nil {
+		return err
+	}
+
+	cookies := make([]*http.Cookie, len(tags["HTTP_SET_COOKIE"]))
+	for i, value := range tags["HTTP_SET_COOKIE"] {
+		cookie, err := ParseSetCookie(value)
+		if err != nil {
+			return err
 		}
+		cookies[i] = cookie
 	}
 
-	// All other tags must be applied before HTTP_STATUS_CODE
-	for key, values := range tags {
-		value := values[len(values)-1]
-		switch key {
-		case "HTTP_STATUS_CODE":
-			log.Print("setting status code")
-			status, err := strconv.ParseInt(value, 10, 32)
-			if err != nil {
-				return err
-			}
-			w.WriteHeader(int(status))
+	etag, lastModified, err := ValidatorTags(tags)
+	if err != nil {
+		return err
+	}
+
+	compress := true
+	if values, ok := tags["HTTP_COMPRESS"]; ok {
+		compress, err = strconv.ParseBool(values[len(values)-1])
+		if err != nil {
+			return fmt.Errorf("invalid HTTP_COMPRESS value %s", values[len(values)-1])
+		}
+	}
+
+	location := ""
+	if values, ok := tags["HTTP_REDIRECT"]; ok {
+		location, err = ResolveLocation(r, values[len(values)-1])
+		if err != nil {
+			return err
 		}
 	}
 
+	// Headers are set in a fixed order, the dedicated tags override the
+	// HTTP_HEADER_ tags for the same header
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		if strings.HasPrefix(key, HeaderTagPrefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		name := HeaderName(strings.TrimPrefix(key, HeaderTagPrefix))
+		if guardedHeaders[name] {
+			log.Printf("refusing to set %s header", name)
+			continue
+		}
+
+		log.Printf("setting %s header", strings.ToLower(name))
+		w.Header().Del(name)
+		for _, v := range tags[key] {
+			w.Header().Add(name, v)
+		}
+	}
+
+	if values, ok := tags["HTTP_CONTENT_TYPE"]; ok {
+		log.Print("setting content-type header")
+		w.Header().Set("Content-Type", values[len(values)-1])
+	}
+	if location != "" {
+		log.Printf("redirecting to %s", location)
+		w.Header().Set("Location", location)
+	}
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+	}
+
+	for _, value := range tags["HTTP_UNSET_HEADER"] {
+		name := HeaderName(value)
+		if guardedHeaders[name] {
+			log.Printf("refusing to unset %s header", name)
+			continue
+		}
+
+		log.Printf("unsetting %s header", strings.ToLower(name))
+		w.Header().Del(name)
+	}
+
+	for _, cookie := range cookies {
+		log.Printf("setting cookie %s", cookie.Name)
+		http.SetCookie(w, cookie)
+	}
+
+	if !compress {
+		DisableCompression(r)
+	}
+
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	if location != "" && len(b) == 0 && (r.Method == "GET" || r.Method == "HEAD") {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		}
+		b = []byte(fmt.Sprintf("<a href=\"%s\">%s</a>.\n", html.EscapeString(location), http.StatusText(status)))
+	}
+
+	safe := r.Method == "GET" || r.Method == "HEAD"
+	if safe && status >= 200 && status < 300 && (etag != "" || !lastModified.IsZero()) {
+		if precondition := CheckPreconditions(r, etag, lastModified); precondition != 0 {
+			log.Printf("conditional request responded with %d", precondition)
+			w.WriteHeader(precondition)
+			return nil
+		}
+	}
+
+	log.Printf("setting status code %d", status)
+	w.WriteHeader(status)
+	w.Write(b)
+
 	return nil
 }
+
+// ResponseStatus returns the status code for the tags. A redirect uses
+// HTTP_REDIRECT_STATUS, then HTTP_STATUS_CODE if it is a redirect status,
+// then 303. Other responses use HTTP_STATUS_CODE or 200.
+func ResponseStatus(tags Tags) (int, error) {
+	status := http.StatusOK
+	if values, ok := tags["HTTP_STATUS_CODE"]; ok {
+		code, err := strconv.ParseInt(values[len(values)-1], 10, 32)
+		if err != nil || code < 100 || code > 599 {
+			return 0, fmt.Errorf("invalid HTTP_STATUS_CODE value %s", values[len(values)-1])
+		}
+		status = int(code)
+	}
+
+	redirectStatus, hasRedirectStatus := tags["HTTP_REDIRECT_STATUS"]
+	if _, ok := tags["HTTP_REDIRECT"]; !ok {
+		if hasRedirectStatus {
+			return 0, errors.New("HTTP_REDIRECT_STATUS requires HTTP_REDIRECT")
+		}
+		return status, nil
+	}
+
+	if hasRedirectStatus {
+		value := redirectStatus[len(redirectStatus)-1]
+		code, err := strconv.Atoi(value)
+		if err != nil || !isRedirectStatus(code) {
+			return 0, fmt.Errorf("invalid HTTP_REDIRECT_STATUS value %s", value)
+		}
+		return code, nil
+	}
+
+	if isRedirectStatus(status) {
+		return status, nil
+	}
+	return http.StatusSeeOther, nil
+}
+
+func isRedirectStatus(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// ResolveLocation resolves a redirect location against the request path,
+// absolute URLs are returned unchanged
+func ResolveLocation(r *http.Request, location string) (string, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return "", fmt.Errorf("invalid HTTP_REDIRECT value %s: %s", location, err)
+	}
+
+	if u.IsAbs() || u.Host != "" {
+		return u.String(), nil
+	}
+
+	base := &url.URL{Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+	return base.ResolveReference(u).String(), nil
+}
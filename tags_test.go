@@ -24,7 +24,33 @@ HTTP_STATUS_CODE: 201
 				"HTTP_CONTENT_TYPE": []string{"application/json"},
 				"HTTP_STATUS_CODE":  []string{"201"},
 			},
-			rest: "{ \"user\": { \"name\": \"Patrick\" } }\n",
+			rest: "{ \"user\": { \"name\": \"Patrick\" } }",
+		},
+		{
+			stdout: "HTTP_CONTENT_TYPE: image/png\r\n\r\n\x89PNG\r\n\x1a\n\x00\x00\n\n",
+			tags: switchboard.Tags{
+				"HTTP_CONTENT_TYPE": []string{"image/png"},
+			},
+			rest: "\x89PNG\r\n\x1a\n\x00\x00\n\n",
+		},
+		{
+			stdout: "HTTP_STATUS_CODE: 200\n\n" + strings.Repeat("a", 100*1024) + "\n",
+			tags: switchboard.Tags{
+				"HTTP_STATUS_CODE": []string{"200"},
+			},
+			rest: strings.Repeat("a", 100*1024) + "\n",
+		},
+		{
+			stdout: "\nplain output\r\n\nwithout tags",
+			tags:   switchboard.Tags{},
+			rest:   "\nplain output\r\n\nwithout tags",
+		},
+		{
+			stdout: "HTTP_REDIRECT: /login",
+			tags: switchboard.Tags{
+				"HTTP_REDIRECT": []string{"/login"},
+			},
+			rest: "",
 		},
 	}
 )
@@ -61,3 +87,52 @@ func TestParseTags(t *testing.T) {
 		}
 	}
 }
+
+func TestApplyBetweenTagsEnv(t *testing.T) {
+	for _, test := range []struct {
+		env      []string
+		tags     switchboard.Tags
+		expected []string
+		err      bool
+	}{
+		{
+			env:      []string{"HTTP_METHOD=GET"},
+			tags:     switchboard.Tags{"ENV_SET": {"USER_ID=1", "QUERY=a=b"}},
+			expected: []string{"HTTP_METHOD=GET", "USER_ID=1", "QUERY=a=b"},
+		},
+		{
+			env:      []string{"USER_ID=1", "ROLE=admin", "PATH=/bin"},
+			tags:     switchboard.Tags{"ENV_UNSET": {"ROLE"}, "ENV_SET": {"USER_ID=2"}, "ENV_APPEND": {"PATH=:/usr/bin", "SCOPES=read"}},
+			expected: []string{"USER_ID=2", "PATH=/bin:/usr/bin", "SCOPES=read"},
+		},
+		{
+			env:  []string{"HTTP_METHOD=GET"},
+			tags: switchboard.Tags{"ENV_SET": {"HTTP_METHOD=POST"}},
+			err:  true,
+		},
+		{
+			tags: switchboard.Tags{"ENV_UNSET": {"TAG_HTTP_STATUS_CODE"}},
+			err:  true,
+		},
+		{
+			tags: switchboard.Tags{"ENV_SET": {"USER_ID"}},
+			err:  true,
+		},
+	} {
+		env := test.env
+		_, err := switchboard.ApplyBetweenTags(test.tags, make(switchboard.Tags), &env)
+		if test.err {
+			if err == nil {
+				t.Errorf("expected ApplyBetweenTags to return an error for %v", test.tags)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("ApplyBetweenTags returned an error: %s", err)
+		}
+
+		if strings.Join(env, " ") != strings.Join(test.expected, " ") {
+			t.Errorf("expected env to be %v, got %v", test.expected, env)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package switchboard
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+const (
+	StringQueryType  = "string"
+	IntegerQueryType = "integer"
+	NumberQueryType  = "number"
+	BooleanQueryType = "boolean"
+
+	DefaultRequestMaxBodySize = 10 * 1024 * 1024
+)
+
+// RequestRules are checked before any stage of a route's pipeline runs so
+// invalid requests are rejected without executing commands:
+//
+//   headers
+//   Headers that must be present, otherwise 400
+//
+//   content_types
+//   Media types allowed for request bodies, otherwise 415. A type may end in
+//   "/*" to allow any subtype.
+//
+//   query
+//   Query parameters and their types (string, integer, number or boolean),
+//   otherwise 400
+//
+//   params
+//   Patterns path variables must fully match, otherwise 400
+//
+//   schema
+//   A JSON Schema the body must satisfy, 400 if the body is not JSON and 422
+//   if it does not match the schema. GET, HEAD and DELETE requests without a
+//   body are not checked.
+//
+//   max_body_size
+//   The largest body in bytes read to check the schema, otherwise 413
+//
+// Failures respond with a JSON body describing each invalid field.
+type RequestRules struct {
+	Headers      []string
+	ContentTypes []string
+	Query        map[string]QueryRule
+	Params       map[string]*regexp.Regexp
+	Schema       *gojsonschema.Schema
+	SchemaSource interface{}
+	MaxBodySize  int64
+}
+
+type QueryRule struct {
+	Type     string
+	Required bool
+}
+
+// ValidationError describes why a request was rejected
+type ValidationError struct {
+	Status  int          `json:"status"`
+	Message string       `json:"error"`
+	Errors  []FieldError `json:"errors,omitempty"`
+}
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (err *ValidationError) Error() string {
+	return err.Message
+}
+
+// Body returns the error encoded as JSON
+func (err *ValidationError) Body() string {
+	b, _ := json.Marshal(err)
+	return string(b)
+}
+
+func NewSchema(source interface{}) (*gojsonschema.Schema, error) {
+	return gojsonschema.NewSchema(gojsonschema.NewGoLoader(source))
+}
+
+// Validate checks the request against the rules. The body is only checked
+// when the rules include a schema.
+func (rules *RequestRules) Validate(r *http.Request, body []byte) *ValidationError {
+	var errs []FieldError
+	for _, header := range rules.Headers {
+		if r.Header.Get(header) == "" {
+			errs = append(errs, FieldError{Field: header, Message: "header is required"})
+		}
+	}
+	if len(errs) > 0 {
+		return &ValidationError{Status: http.StatusBadRequest, Message: "missing required headers", Errors: errs}
+	}
+
+	if len(rules.ContentTypes) > 0 && r.ContentLength != 0 && !rules.allowsContentType(r.Header.Get("Content-Type")) {
+		return &ValidationError{
+			Status:  http.StatusUnsupportedMediaType,
+			Message: fmt.Sprintf("content type must be one of %s", strings.Join(rules.ContentTypes, ", ")),
+		}
+	}
+
+	vars := mux.Vars(r)
+	names := make([]string, 0, len(rules.Params))
+	for name := range rules.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !rules.Params[name].MatchString(vars[name]) {
+			errs = append(errs, FieldError{Field: name, Message: fmt.Sprintf("must match %s", rules.Params[name])})
+		}
+	}
+	if len(errs) > 0 {
+		return &ValidationError{Status: http.StatusBadRequest, Message: "invalid path parameters", Errors: errs}
+	}
+
+	names = make([]string, 0, len(rules.Query))
+	for name := range rules.Query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	query := r.URL.Query()
+	for _, name := range names {
+		rule := rules.Query[name]
+		values, ok := query[name]
+		if !ok {
+			if rule.Required {
+				errs = append(errs, FieldError{Field: name, Message: "query parameter is required"})
+			}
+			continue
+		}
+
+		for _, value := range values {
+			if !validQueryValue(rule.Type, value) {
+				errs = append(errs, FieldError{Field: name, Message: fmt.Sprintf("must be of type %s", rule.Type)})
+				break
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return &ValidationError{Status: http.StatusBadRequest, Message: "invalid query parameters", Errors: errs}
+	}
+
+	// Reads and deletes are usually sent without a body
+	bodyless := r.Method == "GET" || r.Method == "HEAD" || r.Method == "DELETE"
+	if rules.Schema == nil || (bodyless && len(body) == 0) {
+		return nil
+	}
+
+	var document interface{}
+	if err := json.Unmarshal(body, &document); err != nil {
+		return &ValidationError{Status: http.StatusBadRequest, Message: fmt.Sprintf("request body must be JSON: %s", err)}
+	}
+
+	result, err := rules.Schema.Validate(gojsonschema.NewGoLoader(document))
+	if err != nil {
+		return &ValidationError{Status: http.StatusBadRequest, Message: err.Error()}
+	}
+	for _, rerr := range result.Errors() {
+		errs = append(errs, FieldError{Field: rerr.Field(), Message: rerr.Description()})
+	}
+	if len(errs) > 0 {
+		return &ValidationError{Status: http.StatusUnprocessableEntity, Message: "request body is invalid", Errors: errs}
+	}
+
+	return nil
+}
+
+func (rules *RequestRules) allowsContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	for _, allowed := range rules.ContentTypes {
+		allowed = strings.ToLower(allowed)
+		if allowed == mediaType {
+			return true
+		}
+		if strings.HasSuffix(allowed, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(allowed, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rules returns the request rules of each route in the pipeline
+func (pipeline Pipeline) Rules() []*RequestRules {
+	var rules []*RequestRules
+	for _, route := range pipeline {
+		switch r := route.(type) {
+		case *BasicRoute:
+			if r.Request != nil {
+				rules = append(rules, r.Request)
+			}
+		case *ResourceRoute:
+			if r.Request != nil {
+				rules = append(rules, r.Request)
+			}
+		}
+	}
+	return rules
+}
+
+// Validate checks the request against the rules of each route in the
+// pipeline and returns the request body to use as STDIN
+func (pipeline Pipeline) Validate(r *http.Request) (io.Reader, *ValidationError) {
+	rules := pipeline.Rules()
+
+	readBody := false
+	maxSize := int64(0)
+	for _, rule := range rules {
+		if rule.Schema == nil {
+			continue
+		}
+		readBody = true
+		if maxSize == 0 || rule.MaxBodySize < maxSize {
+			maxSize = rule.MaxBodySize
+		}
+	}
+
+	var body []byte
+	if readBody && r.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(io.LimitReader(r.Body, maxSize+1))
+		if err != nil {
+			return nil, &ValidationError{Status: http.StatusBadRequest, Message: fmt.Sprintf("failed to read request body: %s", err)}
+		}
+		if int64(len(body)) > maxSize {
+			return nil, &ValidationError{Status: http.StatusRequestEntityTooLarge, Message: "request body too large"}
+		}
+	}
+
+	for _, rule := range rules {
+		if verr := rule.Validate(r, body); verr != nil {
+			return nil, verr
+		}
+	}
+
+	if readBody {
+		return bytes.NewReader(body), nil
+	}
+	return r.Body, nil
+}
+
+func validQueryValue(queryType string, value string) bool {
+	var err error
+	switch queryType {
+	case IntegerQueryType:
+		_, err = strconv.ParseInt(value, 10, 64)
+	case NumberQueryType:
+		_, err = strconv.ParseFloat(value, 64)
+	case BooleanQueryType:
+		_, err = strconv.ParseBool(value)
+	}
+	return err == nil
+}